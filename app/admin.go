@@ -0,0 +1,131 @@
+package app
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+	"todo-api/app/logging"
+	"todo-api/app/version"
+)
+
+type runtimeStats struct {
+	Uptime        string     `json:"uptime"`
+	Goroutines    int        `json:"goroutines"`
+	GOMAXPROCS    int        `json:"gomaxprocs"`
+	CPUs          int        `json:"cpus"`
+	HeapAlloc     uint64     `json:"heap_alloc_bytes"`
+	HeapInuse     uint64     `json:"heap_inuse_bytes"`
+	HeapObjects   uint64     `json:"heap_objects"`
+	TotalAlloc    uint64     `json:"total_alloc_bytes"`
+	Sys           uint64     `json:"sys_bytes"`
+	NumGC         uint32     `json:"gc_count"`
+	NextGC        uint64     `json:"gc_next_bytes"`
+	PauseTotal    string     `json:"gc_pause_total"`
+	LastGC        *time.Time `json:"gc_last,omitempty"`
+	GCCPUFraction float64    `json:"gc_cpu_fraction"`
+}
+
+type buildInfo struct {
+	Version   string            `json:"version"`
+	Commit    string            `json:"commit,omitempty"`
+	Date      string            `json:"date,omitempty"`
+	GoVersion string            `json:"go_version"`
+	Module    string            `json:"module,omitempty"`
+	Settings  map[string]string `json:"settings,omitempty"`
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// adminHandler serves the endpoints meant for operators, which are kept off
+// the public listener.
+func (a *App) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	if h := a.obs.MetricsHandler(); h != nil {
+		mux.Handle("GET /metrics", h)
+	}
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/runtime", runtimeHandler)
+	mux.HandleFunc("GET /version", buildInfoHandler)
+	mux.HandleFunc("GET /config", a.configHandler)
+	mux.HandleFunc("GET /loglevel", a.getLogLevelHandler)
+	mux.HandleFunc("PUT /loglevel", a.setLogLevelHandler)
+	return mux
+}
+
+// configHandler returns the effective configuration, with secrets redacted.
+// It is not part of the API documentation, which covers the public listener.
+func (a *App) configHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	sendJSON(w, a.config.Load().Values())
+}
+
+func runtimeHandler(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := runtimeStats{
+		Uptime:        time.Since(startTime).Round(time.Second).String(),
+		Goroutines:    runtime.NumGoroutine(),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		CPUs:          runtime.NumCPU(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapInuse:     mem.HeapInuse,
+		HeapObjects:   mem.HeapObjects,
+		TotalAlloc:    mem.TotalAlloc,
+		Sys:           mem.Sys,
+		NumGC:         mem.NumGC,
+		NextGC:        mem.NextGC,
+		PauseTotal:    time.Duration(mem.PauseTotalNs).String(),
+		GCCPUFraction: mem.GCCPUFraction,
+	}
+	if mem.LastGC > 0 {
+		last := time.Unix(0, int64(mem.LastGC)).UTC()
+		stats.LastGC = &last
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	sendJSON(w, stats)
+}
+
+func buildInfoHandler(w http.ResponseWriter, r *http.Request) {
+	info := buildInfo{
+		Version:   version.Version,
+		Commit:    version.Commit,
+		Date:      version.Date,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Module = bi.Main.Path
+		info.Settings = make(map[string]string, len(bi.Settings))
+		for _, setting := range bi.Settings {
+			info.Settings[setting.Key] = setting.Value
+		}
+	}
+	sendJSON(w, info)
+}
+
+func (a *App) getLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, logLevel{Level: a.logLevel.Level().String()})
+}
+
+// setLogLevelHandler changes the level of the logs until the next restart or
+// configuration reload.
+func (a *App) setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var body logLevel
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	level, err := logging.ParseLevel(body.Level)
+	if err != nil {
+		sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.logLevel.Set(level)
+	sendJSON(w, logLevel{Level: level.String()})
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"todo-api/app/config"
+	"todo-api/app/middleware"
+
+	"gotest.tools/v3/assert"
+)
+
+func getConfig(t *testing.T, srv *App) map[string]any {
+	t.Helper()
+	if srv.obs == nil {
+		srv.obs = newTestObserver()
+		t.Cleanup(srv.obs.Shutdown)
+	}
+	w := httptest.NewRecorder()
+	srv.adminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	values := make(map[string]any)
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&values))
+	return values
+}
+
+func TestConfigHandler(t *testing.T) {
+	srv, _ := newMockApp(false)
+	values := getConfig(t, srv)
+	assert.Equal(t, ":8080", values["listen"])
+	database := values["database"].(map[string]any)
+	assert.Equal(t, config.Redacted, database["password"])
+	assert.Equal(t, "30m0s", database["conn_max_lifetime"])
+}
+
+func TestReload(t *testing.T) {
+	srv, _ := newMockApp(false)
+	next := config.Default()
+	next.Log.Level = slog.LevelDebug
+	next.RateLimit.Write = middleware.RateLimit{Rate: 1, Burst: 1}
+	next.Listen = ":9090"
+
+	cfg := srv.Reload(next)
+	assert.Equal(t, slog.LevelDebug, cfg.Log.Level)
+	assert.Equal(t, ":8080", cfg.Listen)
+
+	values := getConfig(t, srv)
+	assert.Equal(t, "1:1", values["rate_limit"].(map[string]any)["write"])
+
+	handler := srv.write.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	codes := make([]int, 0)
+	for range 2 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/todos", nil))
+		codes = append(codes, w.Code)
+	}
+	assert.DeepEqual(t, []int{http.StatusOK, http.StatusTooManyRequests}, codes)
+}
+
+func TestAdminHandler(t *testing.T) {
+	srv, _ := newMockApp(false)
+	srv.obs = newTestObserver()
+	defer srv.obs.Shutdown()
+	handler := srv.adminHandler()
+
+	get := func(path string, v any) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if v != nil {
+			assert.NilError(t, json.NewDecoder(w.Body).Decode(v))
+		}
+		return w.Code
+	}
+
+	var stats runtimeStats
+	assert.Equal(t, http.StatusOK, get("/debug/runtime", &stats))
+	assert.Assert(t, stats.Goroutines > 0)
+
+	var info buildInfo
+	assert.Equal(t, http.StatusOK, get("/version", &info))
+	assert.Equal(t, "dev", info.Version)
+
+	assert.Equal(t, http.StatusOK, get("/debug/pprof/goroutine?debug=1", nil))
+	// The Prometheus exporter is disabled by the test observer
+	assert.Equal(t, http.StatusNotFound, get("/metrics", nil))
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	srv, _ := newMockApp(false)
+	srv.obs = newTestObserver()
+	defer srv.obs.Shutdown()
+	handler := srv.adminHandler()
+
+	put := func(body string) (int, logLevel) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/loglevel", strings.NewReader(body)))
+		var level logLevel
+		json.NewDecoder(w.Body).Decode(&level)
+		return w.Code, level
+	}
+
+	code, level := put(`{"level": "debug"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "DEBUG", level.Level)
+	assert.Equal(t, slog.LevelDebug, srv.logLevel.Level())
+
+	code, _ = put(`{"level": "verbose"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, slog.LevelDebug, srv.logLevel.Level())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/loglevel", nil))
+	assert.Equal(t, `{"level":"DEBUG"}`+"\n", w.Body.String())
+
+	// Reloading the configuration restores its level
+	srv.Reload(config.Default())
+	assert.Equal(t, slog.LevelInfo, srv.logLevel.Level())
+}
@@ -2,13 +2,22 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
 	"embed"
+	"errors"
+	"fmt"
 	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
-	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"todo-api/app/config"
 	"todo-api/app/database"
 	"todo-api/app/middleware"
+	"todo-api/app/version"
 
 	_ "todo-api/app/docs"
 
@@ -19,71 +28,244 @@ import (
 var web embed.FS
 
 type App struct {
-	db     database.TodoDB
-	router *http.ServeMux
-	server *http.Server
-	obs    *middleware.Observer
+	config       atomic.Pointer[config.Config]
+	logLevel     *slog.LevelVar
+	db           database.TodoDB
+	dbReady      atomic.Bool
+	dbMigrated   atomic.Bool
+	shuttingDown atomic.Bool
+	drainDelay   time.Duration
+	retry        retryConfig
+	router       *http.ServeMux
+	server       *http.Server
+	redirect     *http.Server
+	admin        *http.Server
+	errc         chan error
+	obs          *middleware.Observer
+	limits       *middleware.RateLimits
+	read         *middleware.RateLimiter
+	write        *middleware.RateLimiter
+	cors         *middleware.CORS
+	idem         *middleware.Idempotency
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
 }
 
-func New() *App {
+// New creates the application from settings that were already validated,
+// with the level of the logs that can be changed at runtime.
+func New(cfg *config.Config, level *slog.LevelVar) *App {
+	proxies, _ := middleware.ParseTrustedProxies(strings.Join(cfg.RateLimit.TrustedProxies, ","))
 	a := &App{
-		db:     database.New(),
-		router: http.NewServeMux(),
+		logLevel:   level,
+		db:         database.New(cfg.Database),
+		retry:      getRetryConfig(cfg.Database),
+		drainDelay: cfg.ShutdownDrainDelay,
+		router:     http.NewServeMux(),
+		limits:     middleware.NewRateLimits(proxies),
+		idem:       middleware.NewIdempotency(cfg.IdempotencyTTL),
 	}
+	a.config.Store(cfg)
 	a.initRoutes()
 	return a
 }
 
+// Reload applies the settings that can change at runtime, returning the
+// effective configuration.
+func (a *App) Reload(next *config.Config) *config.Config {
+	cfg, restart := a.config.Load().Reload(next)
+	if restart {
+		slog.Warn("some settings only change after a restart")
+	}
+	a.read.SetLimit(cfg.RateLimit.Read)
+	a.write.SetLimit(cfg.RateLimit.Write)
+	a.logLevel.Set(cfg.Log.Level)
+	a.config.Store(cfg)
+	return cfg
+}
+
+// api wraps the handlers of the API with CORS, rate limiting, the check for
+// database availability and the limit on the size of request bodies.
+func (a *App) api(limiter *middleware.RateLimiter, h http.Handler) http.Handler {
+	return a.apiMaxBody(limiter, a.config.Load().Server.MaxBodyBytes, h)
+}
+
+// apiMaxBody is api with another limit on the size of request bodies, for
+// the uploads of files.
+func (a *App) apiMaxBody(limiter *middleware.RateLimiter, maxBody int, h http.Handler) http.Handler {
+	return a.cors.Wrap(limiter.Wrap(a.requireDB(middleware.LimitBody(int64(maxBody), h))))
+}
+
 func (a *App) initRoutes() {
-	a.router.HandleFunc("POST /api/v1/todos", a.addTodoHandler)
-	a.router.HandleFunc("GET /api/v1/todos", a.getTodosHandler)
-	a.router.HandleFunc("GET /api/v1/todos/{id}", a.getTodoHandler)
-	a.router.HandleFunc("PUT /api/v1/todos/{id}", a.updateTodoHandler)
-	a.router.HandleFunc("DELETE /api/v1/todos/{id}", a.deleteTodoHandler)
-	a.router.Handle("GET /swagger/*", httpSwagger.Handler())
+	cfg := a.config.Load()
+	a.read = a.limits.Group("read", cfg.RateLimit.Read)
+	a.write = a.limits.Group("write", cfg.RateLimit.Write)
+	read, write := a.read, a.write
+	a.cors = middleware.NewCORS(middleware.CORSOptions{
+		AllowedOrigins:   cfg.CORS.AllowedOrigins,
+		AllowedMethods:   cfg.CORS.AllowedMethods,
+		AllowedHeaders:   cfg.CORS.AllowedHeaders,
+		ExposedHeaders:   cfg.CORS.ExposedHeaders,
+		AllowCredentials: cfg.CORS.AllowCredentials,
+		MaxAge:           cfg.CORS.MaxAge,
+	})
+
+	a.router.Handle("POST /api/v1/todos", a.api(write, a.idem.Wrap(http.HandlerFunc(a.addTodoHandler))))
+	a.router.Handle("GET /api/v1/todos", a.api(read, http.HandlerFunc(a.getTodosHandler)))
+	a.router.Handle("POST /api/v1/todos/import", a.apiMaxBody(write, cfg.Server.MaxImportBytes, a.idem.Wrap(http.HandlerFunc(a.importTodosHandler))))
+	a.router.Handle("GET /api/v1/todos/export", a.api(read, http.HandlerFunc(a.exportTodosHandler)))
+	a.router.Handle("GET /api/v1/todos/{id}", a.api(read, http.HandlerFunc(a.getTodoHandler)))
+	a.router.Handle("PUT /api/v1/todos/{id}", a.api(write, http.HandlerFunc(a.updateTodoHandler)))
+	a.router.Handle("DELETE /api/v1/todos/{id}", a.api(write, http.HandlerFunc(a.deleteTodoHandler)))
+	a.router.Handle("GET /api/v1/todos/{id}/history", a.api(read, http.HandlerFunc(a.getTodoHistoryHandler)))
+	a.router.Handle("POST /api/v1/todos/{id}/revert", a.api(write, a.idem.Wrap(http.HandlerFunc(a.revertTodoHandler))))
+	if a.cors.Enabled() {
+		// Preflight requests are answered by the CORS middleware
+		a.router.Handle("OPTIONS /api/", a.cors.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})))
+	}
+	a.router.HandleFunc("GET /config.json", a.webConfigHandler)
+	a.router.HandleFunc("GET /healthz", a.livenessHandler)
+	a.router.HandleFunc("GET /readyz", a.readinessHandler)
+	a.router.HandleFunc("GET /health", a.healthHandler)
+	a.router.Handle("GET /swagger/", httpSwagger.Handler())
 
 	dist, err := fs.Sub(web, "web/dist")
 	if err != nil {
 		slog.Error("cannot mount web interfce", slog.String("error", err.Error()))
 		return
 	}
-	a.router.Handle("/", http.FileServer(http.FS(dist)))
+	a.router.Handle("GET /", staticHandler(dist, contentSecurityPolicy(cfg.Web)))
 }
 
-func (a *App) Start(ctx context.Context) {
-	if err := a.db.Init(); err != nil {
-		slog.Error(err.Error())
-		os.Exit(1)
-	}
+// Start listens on the configured addresses and serves the API in the
+// background, returning an error when a listener cannot be opened. Errors
+// happening later are reported through Errors.
+func (a *App) Start(ctx context.Context) error {
+	cfg := a.config.Load()
 
-	listenAddress := ":8080"
-	if value, ok := os.LookupEnv("API_LISTEN"); ok {
-		listenAddress = value
+	var tc *tls.Config
+	if cfg.TLS.Enabled() {
+		var err error
+		if tc, err = newTLSConfig(cfg.TLS); err != nil {
+			return fmt.Errorf("cannot configure TLS: %w", err)
+		}
 	}
-
-	a.obs = middleware.NewObserver(ctx, a.router)
-
-	a.server = &http.Server{
-		Addr:    listenAddress,
-		Handler: a.obs,
+	compression, err := middleware.NewCompression(cfg.Server.Compression, cfg.Server.CompressMinBytes)
+	if err != nil {
+		return err
+	}
+	ln, err := listen(cfg.Listen, cfg.FileMode())
+	if err != nil {
+		return err
+	}
+	var redirectLn net.Listener
+	if tc != nil && cfg.TLS.RedirectListen != "" {
+		if redirectLn, err = listen(cfg.TLS.RedirectListen, cfg.FileMode()); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	var adminLn net.Listener
+	if cfg.AdminListen != "" {
+		if adminLn, err = listen(cfg.AdminListen, cfg.FileMode()); err != nil {
+			ln.Close()
+			if redirectLn != nil {
+				redirectLn.Close()
+			}
+			return err
+		}
 	}
 
+	ctx, a.cancel = context.WithCancel(ctx)
+	a.errc = make(chan error, 3)
+	a.obs = middleware.NewObserver(ctx, a.router,
+		middleware.WithLatencyBuckets(cfg.Metrics.LatencyBuckets),
+		middleware.WithSizeBuckets(cfg.Metrics.SizeBuckets),
+		middleware.WithMetricExporters(middleware.ParseMetricExporters(strings.Join(cfg.Metrics.Exporters, ","))),
+		middleware.WithServiceInfo("todo-api", version.Version, cfg.Environment),
+		middleware.WithSampleRatio(cfg.Tracing.SampleRatio),
+	)
+	a.obs.Register(a.limits)
+
+	// The server starts in degraded mode until the database is reachable
+	a.wg.Add(1)
 	go func() {
-		slog.Info("starting server", "address", listenAddress)
-		if err := a.server.ListenAndServe(); err != nil {
-			slog.Warn(err.Error())
-			if err != http.ErrServerClosed {
-				os.Exit(1)
-			}
+		defer a.wg.Done()
+		if a.connectDB(ctx) {
+			a.monitorDB(ctx)
 		}
 	}()
+
+	a.server = newServer(cfg.Server, middleware.ClientCertificate(compression.Wrap(a.obs)))
+	a.server.TLSConfig = tc
+	if redirectLn != nil {
+		a.redirect = newServer(cfg.Server, redirectHandler(redirectPort(cfg.TLS, ln.Addr())))
+		slog.Info("redirecting to HTTPS", "address", redirectLn.Addr().String())
+		go a.serve(a.redirect, redirectLn)
+	}
+	if adminLn != nil {
+		a.admin = newServer(cfg.Server, a.adminHandler())
+		slog.Info("starting admin server", "address", adminLn.Addr().String())
+		go a.serve(a.admin, adminLn)
+	}
+	slog.Info("starting server", "address", ln.Addr().String(), "tls", tc != nil)
+	go a.serve(a.server, ln)
+	return nil
 }
 
+// Errors reports servers that stopped unexpectedly.
+func (a *App) Errors() <-chan error {
+	return a.errc
+}
+
+func newServer(cfg config.Server, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// serve runs the server until it is shut down, using TLS when configured.
+func (a *App) serve(srv *http.Server, ln net.Listener) {
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		a.errc <- err
+	}
+}
+
+// Shutdown stops the servers, waiting for active requests up to the
+// configured deadline before closing their connections.
 func (a *App) Shutdown() {
-	if a.server != nil {
-		if err := a.server.Shutdown(context.Background()); err != nil {
-			slog.Warn(err.Error())
+	// Fail readiness first, giving load balancers time to stop sending traffic
+	a.shuttingDown.Store(true)
+	if a.server != nil && a.drainDelay > 0 {
+		slog.Info("draining connections", slog.Duration("delay", a.drainDelay))
+		time.Sleep(a.drainDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.Load().Server.ShutdownTimeout)
+	defer cancel()
+	for _, srv := range []*http.Server{a.redirect, a.server, a.admin} {
+		if srv == nil {
+			continue
 		}
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("closing active connections", slog.String("error", err.Error()))
+			srv.Close()
+		}
+	}
+	if a.cancel != nil {
+		a.cancel()
+		a.wg.Wait()
 	}
 	if a.obs != nil {
 		a.obs.Shutdown()
@@ -1,12 +1,18 @@
 package app
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
-	"os"
+	"net/http/httptest"
 	"testing"
+	"time"
+	"todo-api/app/config"
+	"todo-api/app/middleware"
 
 	"gotest.tools/v3/assert"
 )
@@ -27,18 +33,132 @@ func newMockApp(dbFail bool) (*App, *MockDB) {
 	db := &MockDB{fail: dbFail}
 	db.Init()
 	a := &App{
-		db:     db,
-		router: http.NewServeMux(),
+		logLevel: new(slog.LevelVar),
+		db:       db,
+		retry:    retryConfig{initialInterval: time.Millisecond, maxInterval: time.Millisecond, healthInterval: time.Second},
+		router:   http.NewServeMux(),
+		limits:   middleware.NewRateLimits(nil),
+		idem:     middleware.NewIdempotency(time.Hour),
 	}
+	a.config.Store(config.Default())
+	a.dbReady.Store(true)
+	a.dbMigrated.Store(true)
 	a.initRoutes()
 	return a, db
 }
 
-func TestApp(t *testing.T) {
+func newTestObserver() *middleware.Observer {
+	return middleware.NewObserver(context.Background(), http.NewServeMux(), middleware.WithMetricExporters(nil))
+}
+
+func startMockApp(t *testing.T, cfg *config.Config) *App {
+	t.Helper()
 	srv, _ := newMockApp(false)
 	port, err := getFreePort()
 	assert.NilError(t, err)
-	os.Setenv("API_LISTEN", fmt.Sprintf("localhost:%d", port))
-	srv.Start(context.Background())
+	cfg.Listen = fmt.Sprintf("localhost:%d", port)
+	cfg.AdminListen = "localhost:0"
+	srv.config.Store(cfg)
+	return srv
+}
+
+func TestApp(t *testing.T) {
+	srv := startMockApp(t, config.Default())
+	assert.NilError(t, srv.Start(context.Background()))
+	srv.Shutdown()
+}
+
+func TestAppListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	assert.NilError(t, err)
+	defer ln.Close()
+
+	srv, _ := newMockApp(false)
+	cfg := config.Default()
+	cfg.Listen = ln.Addr().String()
+	srv.config.Store(cfg)
+	assert.ErrorContains(t, srv.Start(context.Background()), "address already in use")
+	srv.Shutdown()
+}
+
+func TestAppShutdownDeadline(t *testing.T) {
+	cfg := config.Default()
+	cfg.Server.ShutdownTimeout = 50 * time.Millisecond
+	srv := startMockApp(t, cfg)
+	started := make(chan struct{})
+	srv.router.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+	assert.NilError(t, srv.Start(context.Background()))
+
+	go http.Get("http://" + cfg.Listen + "/slow")
+	<-started
+	begin := time.Now()
 	srv.Shutdown()
+	assert.Assert(t, time.Since(begin) < time.Second)
+}
+
+func TestCORSRoutes(t *testing.T) {
+	srv, _ := newMockApp(false)
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/api/v1/todos", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	cfg := config.Default()
+	cfg.CORS.AllowedOrigins = []string{"https://app.example.com"}
+	srv.config.Store(cfg)
+	srv.router = http.NewServeMux()
+	srv.initRoutes()
+
+	r := httptest.NewRequest(http.MethodOptions, "/api/v1/todos/1", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+	r.Header.Set("Access-Control-Request-Headers", "Content-Type, If-Match")
+	w = httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/todos", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Other routes don't allow cross-origin requests
+	r = httptest.NewRequest(http.MethodGet, "/health", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestRouteLabels(t *testing.T) {
+	srv, _ := newMockApp(false)
+	obs := middleware.NewObserver(context.Background(), srv.router, middleware.WithMetricExporters(nil))
+	defer obs.Shutdown()
+
+	// The route is read from the request logs, as the metrics of other
+	// observers may be registered first
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+
+	for path, route := range map[string]string{
+		"/api/v1/todos":   "GET /api/v1/todos",
+		"/api/v1/todos/1": "GET /api/v1/todos/{id}",
+		"/api/v1/missing": middleware.UnmatchedRoute,
+		"/missing.js":     middleware.UnmatchedRoute,
+		"/todos/42":       "GET /",
+	} {
+		logs.Reset()
+		obs.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		var record struct {
+			Route string `json:"route"`
+		}
+		assert.NilError(t, json.Unmarshal(logs.Bytes(), &record))
+		assert.Equal(t, route, record.Route, path)
+	}
 }
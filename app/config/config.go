@@ -0,0 +1,453 @@
+// Package config holds the settings of the application, loaded from an
+// optional YAML or TOML file and overridden by environment variables.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"todo-api/app/middleware"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Listen             string        `yaml:"listen" env:"API_LISTEN"`
+	SocketMode         string        `yaml:"socket_mode" env:"API_SOCKET_MODE"`
+	AdminListen        string        `yaml:"admin_listen" env:"ADMIN_LISTEN"`
+	Environment        string        `yaml:"environment" env:"DEPLOYMENT_ENVIRONMENT"`
+	ShutdownDrainDelay time.Duration `yaml:"shutdown_drain_delay" env:"SHUTDOWN_DRAIN_DELAY"`
+	IdempotencyTTL     time.Duration `yaml:"idempotency_ttl" env:"IDEMPOTENCY_TTL"`
+	Server             Server        `yaml:"server"`
+	TLS                TLS           `yaml:"tls"`
+	Log                Log           `yaml:"log"`
+	Database           Database      `yaml:"database"`
+	RateLimit          RateLimit     `yaml:"rate_limit"`
+	CORS               CORS          `yaml:"cors"`
+	Metrics            Metrics       `yaml:"metrics"`
+	Tracing            Tracing       `yaml:"tracing"`
+	Web                Web           `yaml:"web"`
+}
+
+// Server holds the limits of the HTTP server, where zero timeouts mean no
+// timeout.
+type Server struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"API_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"API_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"API_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"API_IDLE_TIMEOUT"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes" env:"API_MAX_HEADER_BYTES"`
+	MaxBodyBytes      int           `yaml:"max_body_bytes" env:"API_MAX_BODY_BYTES"`
+	MaxImportBytes    int           `yaml:"max_import_bytes" env:"API_MAX_IMPORT_BYTES"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"API_SHUTDOWN_TIMEOUT"`
+	Compression       []string      `yaml:"compression" env:"API_COMPRESSION"`
+	CompressMinBytes  int           `yaml:"compress_min_bytes" env:"API_COMPRESS_MIN_BYTES"`
+}
+
+// TLS enables HTTPS on the API listener when a certificate is set.
+type TLS struct {
+	CertFile       string        `yaml:"cert_file" env:"API_TLS_CERT_FILE"`
+	KeyFile        string        `yaml:"key_file" env:"API_TLS_KEY_FILE"`
+	ReloadInterval time.Duration `yaml:"reload_interval" env:"API_TLS_RELOAD_INTERVAL"`
+	ClientCAFile   string        `yaml:"client_ca_file" env:"API_TLS_CLIENT_CA_FILE"`
+	ClientAuth     string        `yaml:"client_auth" env:"API_TLS_CLIENT_AUTH"`
+	RedirectListen string        `yaml:"redirect_listen" env:"API_TLS_REDIRECT_LISTEN"`
+	RedirectPort   int           `yaml:"redirect_port" env:"API_TLS_REDIRECT_PORT"`
+}
+
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+type Log struct {
+	Level  slog.Level `yaml:"level" env:"LOG_LEVEL"`
+	Format string     `yaml:"format" env:"LOG_FORMAT"`
+}
+
+// Database holds the connection settings. When URL is set, it replaces the
+// host, port, name, user and password, though a password file still applies.
+type Database struct {
+	URL                  string        `yaml:"url" env:"DATABASE_URL" secret:"url"`
+	Host                 string        `yaml:"host" env:"POSTGRES_HOST"`
+	Port                 int           `yaml:"port" env:"POSTGRES_PORT"`
+	Name                 string        `yaml:"name" env:"POSTGRES_DB"`
+	User                 string        `yaml:"user" env:"POSTGRES_USER"`
+	Password             string        `yaml:"password" env:"POSTGRES_PASSWORD" secret:"true"`
+	PasswordFile         string        `yaml:"password_file" env:"POSTGRES_PASSWORD_FILE"`
+	SSLMode              string        `yaml:"ssl_mode" env:"POSTGRES_SSLMODE"`
+	SSLRootCert          string        `yaml:"ssl_root_cert" env:"POSTGRES_SSLROOTCERT"`
+	SSLCert              string        `yaml:"ssl_cert" env:"POSTGRES_SSLCERT"`
+	SSLKey               string        `yaml:"ssl_key" env:"POSTGRES_SSLKEY"`
+	AutoMigrate          bool          `yaml:"auto_migrate" env:"POSTGRES_AUTO_MIGRATE"`
+	MaxOpenConns         int           `yaml:"max_open_conns" env:"POSTGRES_MAX_OPEN_CONNS"`
+	MaxIdleConns         int           `yaml:"max_idle_conns" env:"POSTGRES_MAX_IDLE_CONNS"`
+	ConnMaxLifetime      time.Duration `yaml:"conn_max_lifetime" env:"POSTGRES_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime      time.Duration `yaml:"conn_max_idle_time" env:"POSTGRES_CONN_MAX_IDLE_TIME"`
+	StatementTimeout     time.Duration `yaml:"statement_timeout" env:"POSTGRES_STATEMENT_TIMEOUT"`
+	RetryInitialInterval time.Duration `yaml:"retry_initial_interval" env:"POSTGRES_RETRY_INITIAL_INTERVAL"`
+	RetryMaxInterval     time.Duration `yaml:"retry_max_interval" env:"POSTGRES_RETRY_MAX_INTERVAL"`
+	HealthInterval       time.Duration `yaml:"health_interval" env:"POSTGRES_HEALTH_INTERVAL"`
+}
+
+type RateLimit struct {
+	Read           middleware.RateLimit `yaml:"read" env:"RATE_LIMIT_READ"`
+	Write          middleware.RateLimit `yaml:"write" env:"RATE_LIMIT_WRITE"`
+	TrustedProxies []string             `yaml:"trusted_proxies" env:"RATE_LIMIT_TRUSTED_PROXIES"`
+}
+
+// CORS allows web applications hosted on other origins to call the API,
+// none being allowed by default.
+type CORS struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	AllowedMethods   []string      `yaml:"allowed_methods" env:"CORS_ALLOWED_METHODS"`
+	AllowedHeaders   []string      `yaml:"allowed_headers" env:"CORS_ALLOWED_HEADERS"`
+	ExposedHeaders   []string      `yaml:"exposed_headers" env:"CORS_EXPOSED_HEADERS"`
+	AllowCredentials bool          `yaml:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS"`
+	MaxAge           time.Duration `yaml:"max_age" env:"CORS_MAX_AGE"`
+}
+
+type Metrics struct {
+	Exporters      []string      `yaml:"exporters" env:"OTEL_METRICS_EXPORTER"`
+	LatencyBuckets []float64     `yaml:"latency_buckets" env:"METRICS_LATENCY_BUCKETS"`
+	SizeBuckets    []float64     `yaml:"size_buckets" env:"METRICS_SIZE_BUCKETS"`
+	StatsTTL       time.Duration `yaml:"stats_ttl" env:"METRICS_STATS_TTL"`
+}
+
+type Tracing struct {
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACES_SAMPLE_RATIO"`
+}
+
+// Web holds the settings of the web interface, served as /config.json so the
+// same build works in every environment.
+type Web struct {
+	Title      string   `yaml:"title" env:"WEB_TITLE"`
+	APIBaseURL string   `yaml:"api_base_url" env:"WEB_API_BASE_URL"`
+	DocsURL    string   `yaml:"docs_url" env:"WEB_DOCS_URL"`
+	Features   []string `yaml:"features" env:"WEB_FEATURES"`
+	Auth       WebAuth  `yaml:"auth"`
+}
+
+// WebAuth holds the OpenID Connect settings of the web interface, which is a
+// public client without secret.
+type WebAuth struct {
+	Issuer   string   `yaml:"issuer" env:"WEB_AUTH_ISSUER"`
+	ClientID string   `yaml:"client_id" env:"WEB_AUTH_CLIENT_ID"`
+	Scopes   []string `yaml:"scopes" env:"WEB_AUTH_SCOPES"`
+}
+
+// Default returns the settings used when neither the file nor the
+// environment set them.
+func Default() *Config {
+	return &Config{
+		Listen:             ":8080",
+		SocketMode:         "0660",
+		AdminListen:        "localhost:9091",
+		IdempotencyTTL:     24 * time.Hour,
+		ShutdownDrainDelay: 5 * time.Second,
+		Server: Server{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			MaxHeaderBytes:    1 << 20,
+			MaxBodyBytes:      1 << 20,
+			MaxImportBytes:    32 << 20,
+			ShutdownTimeout:   30 * time.Second,
+			Compression:       slices.Clone(middleware.Encodings),
+			CompressMinBytes:  1024,
+		},
+		TLS: TLS{
+			ReloadInterval: 10 * time.Second,
+			ClientAuth:     "none",
+		},
+		Log: Log{
+			Level:  slog.LevelInfo,
+			Format: "text",
+		},
+		Database: Database{
+			Host:                 "localhost",
+			Port:                 5432,
+			Name:                 "todo",
+			User:                 "postgres",
+			Password:             "postgres",
+			AutoMigrate:          true,
+			MaxOpenConns:         25,
+			MaxIdleConns:         5,
+			ConnMaxLifetime:      30 * time.Minute,
+			ConnMaxIdleTime:      5 * time.Minute,
+			RetryInitialInterval: time.Second,
+			RetryMaxInterval:     30 * time.Second,
+			HealthInterval:       10 * time.Second,
+		},
+		RateLimit: RateLimit{
+			Read:  middleware.RateLimit{Rate: 50, Burst: 100},
+			Write: middleware.RateLimit{Rate: 10, Burst: 20},
+		},
+		CORS: CORS{
+			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+			AllowedHeaders: []string{"Content-Type", "Authorization", middleware.APIKeyHeader,
+				middleware.IdempotencyKeyHeader, middleware.RequestIDHeader, "If-Match"},
+			ExposedHeaders: []string{"ETag", "Retry-After", middleware.RequestIDHeader, "Idempotent-Replayed",
+				"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
+			MaxAge: 10 * time.Minute,
+		},
+		Metrics: Metrics{
+			Exporters: []string{middleware.PrometheusExporter},
+			StatsTTL:  30 * time.Second,
+		},
+		Tracing: Tracing{
+			SampleRatio: 1,
+		},
+		Web: Web{
+			Title:      "TODO Application",
+			APIBaseURL: "/api/v1",
+			DocsURL:    "/swagger/index.html",
+			Auth: WebAuth{
+				Scopes: []string{"openid", "profile"},
+			},
+		},
+	}
+}
+
+// Load reads the YAML file at path, or the TOML one when it has the .toml
+// extension, on top of the defaults, then applies the environment variables
+// and validates the result.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(filepath.Ext(path), ".toml") {
+			if data, err = tomlToYAML(data); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+	if err := cfg.readSecrets(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// tomlToYAML converts a TOML document to YAML, so that both formats share the
+// keys and the checks of the YAML decoder.
+func tomlToYAML(data []byte) ([]byte, error) {
+	doc := make(map[string]any)
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(doc)
+}
+
+// readSecrets loads the secrets kept in files, so they stay out of the
+// environment of the process.
+func (c *Config) readSecrets() error {
+	if c.Database.PasswordFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.Database.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("database.password_file: %w", err)
+	}
+	c.Database.Password = strings.TrimRight(string(data), "\r\n")
+	return nil
+}
+
+// Validate checks the settings, reporting every invalid one.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, field, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+		}
+	}
+	check(validListen(c.Listen), "listen", "must be host:port, unix:<path>, systemd or systemd:<name>, got %q", c.Listen)
+	check(c.AdminListen == "" || validListen(c.AdminListen), "admin_listen", "must be host:port, unix:<path>, systemd or systemd:<name>, got %q", c.AdminListen)
+	_, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	check(err == nil, "socket_mode", "must be octal permissions like 0660, got %q", c.SocketMode)
+	check(c.ShutdownDrainDelay >= 0, "shutdown_drain_delay", "must not be negative")
+	check(c.IdempotencyTTL > 0, "idempotency_ttl", "must be positive")
+	srv := c.Server
+	check(srv.ReadHeaderTimeout >= 0, "server.read_header_timeout", "must not be negative")
+	check(srv.ReadTimeout >= 0, "server.read_timeout", "must not be negative")
+	check(srv.WriteTimeout >= 0, "server.write_timeout", "must not be negative")
+	check(srv.IdleTimeout >= 0, "server.idle_timeout", "must not be negative")
+	check(srv.MaxHeaderBytes > 0, "server.max_header_bytes", "must be positive")
+	check(srv.MaxBodyBytes > 0, "server.max_body_bytes", "must be positive")
+	check(srv.MaxImportBytes > 0, "server.max_import_bytes", "must be positive")
+	check(srv.ShutdownTimeout > 0, "server.shutdown_timeout", "must be positive")
+	for _, encoding := range srv.Compression {
+		check(slices.Contains(middleware.Encodings, encoding), "server.compression", "unknown encoding %q, must be one of %s", encoding, strings.Join(middleware.Encodings, ", "))
+	}
+	check(srv.CompressMinBytes >= 0, "server.compress_min_bytes", "must not be negative")
+
+	tc := c.TLS
+	check((tc.CertFile == "") == (tc.KeyFile == ""), "tls.cert_file", "must be set along with key_file")
+	check(tc.ReloadInterval > 0, "tls.reload_interval", "must be positive")
+	check(slices.Contains(clientAuthModes, tc.ClientAuth), "tls.client_auth", "must be one of %s, got %q", strings.Join(clientAuthModes, ", "), tc.ClientAuth)
+	check(tc.ClientAuth == "none" || tc.ClientCAFile != "", "tls.client_ca_file", "must be set to verify client certificates")
+	check(tc.Enabled() || (tc.ClientCAFile == "" && tc.RedirectListen == ""), "tls.cert_file", "must be set to verify clients or redirect to HTTPS")
+	check(tc.RedirectListen == "" || validListen(tc.RedirectListen), "tls.redirect_listen", "must be host:port, unix:<path>, systemd or systemd:<name>, got %q", tc.RedirectListen)
+	check(tc.RedirectPort >= 0 && tc.RedirectPort <= 65535, "tls.redirect_port", "must be a port number, got %d", tc.RedirectPort)
+	checkFiles(check, "tls", "cert_file", tc.CertFile, "key_file", tc.KeyFile, "client_ca_file", tc.ClientCAFile)
+
+	check(slices.Contains([]string{"", "text", "json"}, strings.ToLower(c.Log.Format)), "log.format", "must be text or json, got %q", c.Log.Format)
+
+	db := c.Database
+	if db.URL != "" {
+		u, err := url.Parse(db.URL)
+		check(err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql"), "database.url", "must be a postgres:// URL")
+	} else {
+		check(db.Host != "", "database.host", "must not be empty")
+		check(db.Port > 0 && db.Port < 65536, "database.port", "must be between 1 and 65535, got %d", db.Port)
+		check(db.Name != "", "database.name", "must not be empty")
+		check(db.User != "", "database.user", "must not be empty")
+	}
+	check(slices.Contains(sslModes, db.SSLMode), "database.ssl_mode", "must be one of %s, got %q", strings.Join(sslModes[1:], ", "), db.SSLMode)
+	check((db.SSLCert == "") == (db.SSLKey == ""), "database.ssl_cert", "must be set along with ssl_key")
+	checkFiles(check, "database", "ssl_root_cert", db.SSLRootCert, "ssl_cert", db.SSLCert, "ssl_key", db.SSLKey)
+	check(db.MaxOpenConns >= 0, "database.max_open_conns", "must not be negative")
+	check(db.MaxIdleConns >= 0, "database.max_idle_conns", "must not be negative")
+	check(db.MaxOpenConns == 0 || db.MaxIdleConns <= db.MaxOpenConns, "database.max_idle_conns", "must not exceed max_open_conns (%d)", db.MaxOpenConns)
+	check(db.ConnMaxLifetime >= 0, "database.conn_max_lifetime", "must not be negative")
+	check(db.ConnMaxIdleTime >= 0, "database.conn_max_idle_time", "must not be negative")
+	check(db.StatementTimeout >= 0, "database.statement_timeout", "must not be negative")
+	check(db.RetryInitialInterval > 0, "database.retry_initial_interval", "must be positive")
+	check(db.RetryMaxInterval >= db.RetryInitialInterval, "database.retry_max_interval", "must not be lower than retry_initial_interval (%s)", db.RetryInitialInterval)
+	check(db.HealthInterval > 0, "database.health_interval", "must be positive")
+
+	if _, err := middleware.ParseTrustedProxies(strings.Join(c.RateLimit.TrustedProxies, ",")); err != nil {
+		check(false, "rate_limit.trusted_proxies", "%v", err)
+	}
+
+	cors := c.CORS
+	for _, origin := range cors.AllowedOrigins {
+		check(validOrigin(origin), "cors.allowed_origins", "invalid origin %q, must be like https://app.example.com, https://*.example.com or *", origin)
+	}
+	check(!cors.AllowCredentials || !slices.Contains(cors.AllowedOrigins, "*"), "cors.allow_credentials", "cannot be used with any origin (*)")
+	check(cors.MaxAge >= 0, "cors.max_age", "must not be negative")
+
+	for _, exporter := range c.Metrics.Exporters {
+		check(slices.Contains([]string{middleware.PrometheusExporter, middleware.OTLPExporter, "none"}, exporter),
+			"metrics.exporters", "unknown exporter %q", exporter)
+	}
+	check(increasing(c.Metrics.LatencyBuckets), "metrics.latency_buckets", "must be in increasing order")
+	check(increasing(c.Metrics.SizeBuckets), "metrics.size_buckets", "must be in increasing order")
+	check(c.Metrics.StatsTTL > 0, "metrics.stats_ttl", "must be positive")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio", "must be between 0 and 1, got %g", c.Tracing.SampleRatio)
+
+	web := c.Web
+	check(validWebURL(web.APIBaseURL), "web.api_base_url", "must be a path or an http(s) URL, got %q", web.APIBaseURL)
+	check(web.DocsURL == "" || validWebURL(web.DocsURL), "web.docs_url", "must be a path or an http(s) URL, got %q", web.DocsURL)
+	issuer, err := url.Parse(web.Auth.Issuer)
+	check(web.Auth.Issuer == "" || (err == nil && (issuer.Scheme == "https" || issuer.Scheme == "http") && issuer.Host != ""),
+		"web.auth.issuer", "must be an http(s) URL, got %q", web.Auth.Issuer)
+	check(web.Auth.Issuer == "" || web.Auth.ClientID != "", "web.auth.client_id", "must be set along with issuer")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// FileMode returns the permissions of Unix sockets, validated beforehand.
+func (c *Config) FileMode() os.FileMode {
+	mode, _ := strconv.ParseUint(c.SocketMode, 8, 32)
+	return os.FileMode(mode)
+}
+
+// validWebURL checks URLs used by browsers, either absolute or relative to
+// the server.
+func validWebURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		return strings.HasPrefix(u.Path, "/")
+	}
+	return (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// validOrigin checks the origins allowed by CORS, which have no path and may
+// use a wildcard for subdomains.
+func validOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" &&
+		u.Path == "" && u.RawQuery == "" && u.User == nil && !strings.Contains(u.Host, "*")
+}
+
+// validListen checks the forms of listen addresses supported by the server.
+func validListen(addr string) bool {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return len(addr) > len("unix:")
+	case addr == "systemd" || strings.HasPrefix(addr, "systemd:"):
+		return true
+	default:
+		_, _, err := net.SplitHostPort(addr)
+		return err == nil
+	}
+}
+
+// checkFiles verifies that the files given as field and path pairs exist.
+func checkFiles(check func(bool, string, string, ...any), section string, files ...string) {
+	for i := 0; i+1 < len(files); i += 2 {
+		if field, path := files[i], files[i+1]; path != "" {
+			_, err := os.Stat(path)
+			check(err == nil, section+"."+field, "%v", err)
+		}
+	}
+}
+
+var clientAuthModes = []string{"none", "optional", "require"}
+
+var sslModes = []string{"", "disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+func increasing(values []float64) bool {
+	for i := 1; i < len(values); i++ {
+		if values[i] <= values[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// Reload returns the current settings updated with those of next that can
+// change at runtime: the log level and the rate limits. It also reports
+// whether next changes anything else, which requires a restart.
+func (c *Config) Reload(next *Config) (*Config, bool) {
+	updated := *c
+	updated.Log.Level = next.Log.Level
+	updated.RateLimit.Read = next.RateLimit.Read
+	updated.RateLimit.Write = next.RateLimit.Write
+	return &updated, !reflect.DeepEqual(&updated, next)
+}
@@ -0,0 +1,275 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"todo-api/app/middleware"
+
+	"gotest.tools/v3/assert"
+)
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	return writeFileAs(t, "config.yaml", content)
+}
+
+func writeFileAs(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	assert.NilError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load("")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, Default(), cfg)
+}
+
+func TestLoad(t *testing.T) {
+	path := writeFile(t, `
+listen: ":9090"
+log:
+  level: debug
+database:
+  host: db.example.com
+  max_open_conns: 10
+  conn_max_lifetime: 1h
+rate_limit:
+  read: "5:10"
+  trusted_proxies: [10.0.0.0/8]
+metrics:
+  latency_buckets: [0.1, 0.5, 1]
+`)
+	t.Setenv("POSTGRES_HOST", "env.example.com")
+	t.Setenv("RATE_LIMIT_WRITE", "1")
+	t.Setenv("METRICS_SIZE_BUCKETS", "100, 1000")
+	t.Setenv("POSTGRES_AUTO_MIGRATE", "false")
+
+	cfg, err := Load(path)
+	assert.NilError(t, err)
+	assert.Equal(t, ":9090", cfg.Listen)
+	assert.Equal(t, slog.LevelDebug, cfg.Log.Level)
+	assert.Equal(t, "env.example.com", cfg.Database.Host)
+	assert.Equal(t, 10, cfg.Database.MaxOpenConns)
+	assert.Equal(t, 5, cfg.Database.MaxIdleConns)
+	assert.Equal(t, time.Hour, cfg.Database.ConnMaxLifetime)
+	assert.Equal(t, false, cfg.Database.AutoMigrate)
+	assert.Equal(t, middleware.RateLimit{Rate: 5, Burst: 10}, cfg.RateLimit.Read)
+	assert.Equal(t, middleware.RateLimit{Rate: 1, Burst: 1}, cfg.RateLimit.Write)
+	assert.DeepEqual(t, []string{"10.0.0.0/8"}, cfg.RateLimit.TrustedProxies)
+	assert.DeepEqual(t, []float64{0.1, 0.5, 1}, cfg.Metrics.LatencyBuckets)
+	assert.DeepEqual(t, []float64{100, 1000}, cfg.Metrics.SizeBuckets)
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeFileAs(t, "config.toml", `
+listen = ":9090"
+
+[log]
+level = "debug"
+
+[database]
+host = "db.example.com"
+max_open_conns = 10
+conn_max_lifetime = "1h"
+
+[rate_limit]
+read = "5:10"
+trusted_proxies = ["10.0.0.0/8"]
+
+[metrics]
+latency_buckets = [0.1, 0.5, 1]
+`)
+	cfg, err := Load(path)
+	assert.NilError(t, err)
+	assert.Equal(t, ":9090", cfg.Listen)
+	assert.Equal(t, slog.LevelDebug, cfg.Log.Level)
+	assert.Equal(t, "db.example.com", cfg.Database.Host)
+	assert.Equal(t, 10, cfg.Database.MaxOpenConns)
+	assert.Equal(t, time.Hour, cfg.Database.ConnMaxLifetime)
+	assert.Equal(t, middleware.RateLimit{Rate: 5, Burst: 10}, cfg.RateLimit.Read)
+	assert.DeepEqual(t, []string{"10.0.0.0/8"}, cfg.RateLimit.TrustedProxies)
+	assert.DeepEqual(t, []float64{0.1, 0.5, 1}, cfg.Metrics.LatencyBuckets)
+
+	_, err = Load(writeFileAs(t, "config.toml", "[database]\nhots = \"localhost\"\n"))
+	assert.ErrorContains(t, err, "field hots not found")
+	_, err = Load(writeFileAs(t, "config.toml", "listen = \n"))
+	assert.ErrorContains(t, err, "config.toml")
+}
+
+func TestLoadErrors(t *testing.T) {
+	_, err := Load(writeFile(t, "database:\n  hots: localhost\n"))
+	assert.ErrorContains(t, err, "field hots not found")
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	t.Setenv("POSTGRES_MAX_OPEN_CONNS", "many")
+	_, err = Load("")
+	assert.ErrorContains(t, err, "invalid value for POSTGRES_MAX_OPEN_CONNS")
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Database.Port = 70000
+	cfg.Database.MaxIdleConns = 50
+	cfg.RateLimit.TrustedProxies = []string{"proxy"}
+	cfg.Metrics.Exporters = []string{"statsd"}
+	cfg.Metrics.LatencyBuckets = []float64{1, 0.5}
+	cfg.Tracing.SampleRatio = 2
+	cfg.Server.Compression = []string{"gzip", "deflate"}
+
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "database.port: must be between 1 and 65535, got 70000")
+	assert.ErrorContains(t, err, "database.max_idle_conns: must not exceed max_open_conns (25)")
+	assert.ErrorContains(t, err, `rate_limit.trusted_proxies: invalid trusted proxy "proxy"`)
+	assert.ErrorContains(t, err, `metrics.exporters: unknown exporter "statsd"`)
+	assert.ErrorContains(t, err, "metrics.latency_buckets: must be in increasing order")
+	assert.ErrorContains(t, err, "tracing.sample_ratio: must be between 0 and 1, got 2")
+	assert.ErrorContains(t, err, `server.compression: unknown encoding "deflate", must be one of zstd, br, gzip`)
+}
+
+func TestPasswordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	assert.NilError(t, os.WriteFile(path, []byte("s3cret\n"), 0o600))
+	t.Setenv("POSTGRES_PASSWORD_FILE", path)
+
+	cfg, err := Load("")
+	assert.NilError(t, err)
+	assert.Equal(t, "s3cret", cfg.Database.Password)
+
+	t.Setenv("POSTGRES_PASSWORD_FILE", path+".missing")
+	_, err = Load("")
+	assert.ErrorContains(t, err, "database.password_file: open")
+}
+
+func TestValidateDatabase(t *testing.T) {
+	cfg := Default()
+	cfg.Database.URL = "mysql://db/todo"
+	cfg.Database.SSLMode = "always"
+	cfg.Database.SSLCert = "client.pem"
+
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "database.url: must be a postgres:// URL")
+	assert.ErrorContains(t, err, `database.ssl_mode: must be one of disable, allow, prefer, require, verify-ca, verify-full, got "always"`)
+	assert.ErrorContains(t, err, "database.ssl_cert: must be set along with ssl_key")
+	assert.ErrorContains(t, err, "database.ssl_cert: stat client.pem")
+
+	cfg = Default()
+	cfg.Database.URL = "postgresql://app@db/todo"
+	cfg.Database.Host = ""
+	assert.NilError(t, cfg.Validate())
+}
+
+func TestValidateTLS(t *testing.T) {
+	cfg := Default()
+	cfg.TLS.ClientAuth = "require"
+	cfg.TLS.RedirectListen = ":80"
+	cfg.TLS.KeyFile = "key.pem"
+
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "tls.cert_file: must be set along with key_file")
+	assert.ErrorContains(t, err, "tls.client_ca_file: must be set to verify client certificates")
+	assert.ErrorContains(t, err, "tls.cert_file: must be set to verify clients or redirect to HTTPS")
+	assert.ErrorContains(t, err, "tls.key_file: stat key.pem")
+
+	cfg.TLS.ClientAuth = "always"
+	assert.ErrorContains(t, cfg.Validate(), `tls.client_auth: must be one of none, optional, require, got "always"`)
+}
+
+func TestValidateListen(t *testing.T) {
+	for _, addr := range []string{":8080", "localhost:8080", "unix:/run/todo/api.sock", "systemd", "systemd:api"} {
+		cfg := Default()
+		cfg.Listen = addr
+		assert.NilError(t, cfg.Validate(), addr)
+	}
+
+	cfg := Default()
+	cfg.Listen = "unix:"
+	cfg.SocketMode = "rw"
+	cfg.TLS.CertFile = "cert.pem"
+	cfg.TLS.RedirectListen = "8080"
+	cfg.TLS.RedirectPort = 70000
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, `listen: must be host:port, unix:<path>, systemd or systemd:<name>, got "unix:"`)
+	assert.ErrorContains(t, err, `socket_mode: must be octal permissions like 0660, got "rw"`)
+	assert.ErrorContains(t, err, `tls.redirect_listen: must be host:port, unix:<path>, systemd or systemd:<name>, got "8080"`)
+	assert.ErrorContains(t, err, `tls.redirect_port: must be a port number, got 70000`)
+
+	cfg = Default()
+	cfg.SocketMode = "600"
+	assert.Equal(t, os.FileMode(0o600), cfg.FileMode())
+}
+
+func TestValidateWeb(t *testing.T) {
+	cfg := Default()
+	cfg.Web.APIBaseURL = "api/v1"
+	cfg.Web.DocsURL = "ftp://docs.example.com"
+	cfg.Web.Auth.Issuer = "id.example.com"
+
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, `web.api_base_url: must be a path or an http(s) URL, got "api/v1"`)
+	assert.ErrorContains(t, err, `web.docs_url: must be a path or an http(s) URL, got "ftp://docs.example.com"`)
+	assert.ErrorContains(t, err, `web.auth.issuer: must be an http(s) URL, got "id.example.com"`)
+	assert.ErrorContains(t, err, "web.auth.client_id: must be set along with issuer")
+
+	cfg = Default()
+	cfg.Web.APIBaseURL = "https://api.example.com/api/v1"
+	cfg.Web.Auth = WebAuth{Issuer: "https://id.example.com", ClientID: "todo-web"}
+	assert.NilError(t, cfg.Validate())
+}
+
+func TestValidateCORS(t *testing.T) {
+	cfg := Default()
+	cfg.CORS.AllowedOrigins = []string{"https://app.example.com", "https://*.example.org", "*", "app.example.com", "https://app.example.com/", "https://a*.example.org"}
+	cfg.CORS.AllowCredentials = true
+
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, `cors.allowed_origins: invalid origin "app.example.com"`)
+	assert.ErrorContains(t, err, `cors.allowed_origins: invalid origin "https://app.example.com/"`)
+	assert.ErrorContains(t, err, `cors.allowed_origins: invalid origin "https://a*.example.org"`)
+	assert.ErrorContains(t, err, "cors.allow_credentials: cannot be used with any origin (*)")
+	assert.Assert(t, !strings.Contains(err.Error(), `"https://*.example.org"`))
+}
+
+func TestValues(t *testing.T) {
+	values := Default().Values()
+	assert.Equal(t, ":8080", values["listen"])
+	assert.Equal(t, "24h0m0s", values["idempotency_ttl"])
+
+	database := values["database"].(map[string]any)
+	assert.Equal(t, Redacted, database["password"])
+	assert.Equal(t, 5432, database["port"])
+
+	cfg := Default()
+	cfg.Database.URL = "postgres://app:secret@db/todo"
+	database = cfg.Values()["database"].(map[string]any)
+	assert.Equal(t, "postgres://app:xxxxx@db/todo", database["url"])
+
+	log := values["log"].(map[string]any)
+	assert.Equal(t, "INFO", log["level"])
+	limits := values["rate_limit"].(map[string]any)
+	assert.Equal(t, "50:100", limits["read"])
+}
+
+func TestReload(t *testing.T) {
+	current := Default()
+	next := Default()
+	next.Log.Level = slog.LevelWarn
+	next.RateLimit.Read = middleware.RateLimit{Rate: 1, Burst: 1}
+
+	cfg, restart := current.Reload(next)
+	assert.Assert(t, !restart)
+	assert.Equal(t, slog.LevelWarn, cfg.Log.Level)
+	assert.Equal(t, slog.LevelInfo, current.Log.Level)
+
+	next.Listen = ":9090"
+	cfg, restart = current.Reload(next)
+	assert.Assert(t, restart)
+	assert.Equal(t, ":8080", cfg.Listen)
+}
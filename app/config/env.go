@@ -0,0 +1,136 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Redacted is the text that replaces secrets in Values.
+const Redacted = "REDACTED"
+
+// applyEnv overrides the fields tagged with `env` whose variable is set.
+func applyEnv(v reflect.Value) error {
+	for i := range v.NumField() {
+		field, value := v.Type().Field(i), v.Field(i)
+		if field.Type.Kind() == reflect.Struct && !reflect.PointerTo(field.Type).Implements(textUnmarshalerType) {
+			if err := applyEnv(value); err != nil {
+				return err
+			}
+			continue
+		}
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		if raw, ok := os.LookupEnv(name); ok {
+			if err := setValue(value, raw); err != nil {
+				return fmt.Errorf("invalid value for %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setValue parses raw into v, lists being separated by commas.
+func setValue(v reflect.Value, raw string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(strings.TrimSpace(raw)))
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		v.SetInt(int64(d))
+		return err
+	}
+	var err error
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(strings.TrimSpace(raw))
+		v.SetBool(b)
+	case reflect.Int:
+		var n int64
+		n, err = strconv.ParseInt(strings.TrimSpace(raw), 10, 0)
+		v.SetInt(n)
+	case reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		v.SetFloat(f)
+	case reflect.Slice:
+		items := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, entry := range strings.Split(raw, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err := setValue(item, entry); err != nil {
+				return err
+			}
+			items = reflect.Append(items, item)
+		}
+		v.Set(items)
+	default:
+		err = fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return err
+}
+
+// Values returns the settings as a tree keyed by their YAML names, with
+// durations and other text values formatted, and secrets redacted.
+func (c *Config) Values() map[string]any {
+	return values(reflect.ValueOf(c).Elem())
+}
+
+// redactURL hides the password of a URL, or the whole URL when it cannot be
+// parsed.
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Redacted
+	}
+	return u.Redacted()
+}
+
+func values(v reflect.Value) map[string]any {
+	result := make(map[string]any, v.NumField())
+	for i := range v.NumField() {
+		field, value := v.Type().Field(i), v.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		switch {
+		case field.Tag.Get("secret") == "url":
+			result[name] = redactURL(value.String())
+		case field.Tag.Get("secret") != "":
+			if value.String() != "" {
+				result[name] = Redacted
+			} else {
+				result[name] = ""
+			}
+		case field.Type == durationType:
+			result[name] = value.Interface().(time.Duration).String()
+		case field.Type.Implements(textMarshalerType):
+			text, _ := value.Interface().(encoding.TextMarshaler).MarshalText()
+			result[name] = string(text)
+		case field.Type.Kind() == reflect.Struct:
+			result[name] = values(value)
+		default:
+			result[name] = value.Interface()
+		}
+	}
+	return result
+}
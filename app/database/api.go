@@ -3,17 +3,39 @@ package database
 import (
 	"context"
 	"errors"
+	"time"
 	"todo-api/app/models"
 )
 
 var ErrorNotFound = errors.New("record not found")
+var ErrorConflict = errors.New("version conflict")
+var ErrorNotConnected = errors.New("database not connected")
+var ErrorNoMigrationsTable = errors.New("no migrations table")
+
+// Filter selects the TODOs to list or export. The zero value selects all of
+// them.
+type Filter struct {
+	Completed *bool
+	Priority  int
+	DueBefore *time.Time
+	DueAfter  *time.Time
+	Query     string
+}
 
 type TodoDB interface {
 	Init() error
 	Shutdown()
-	GetAll(ctx context.Context) ([]models.Todo, error)
+	Ping(ctx context.Context) error
+	PendingMigrations(ctx context.Context) (int, error)
+	GetAll(ctx context.Context, filter Filter) ([]models.Todo, error)
+	Each(ctx context.Context, filter Filter, fn func(models.Todo) error) error
 	Get(ctx context.Context, id int) (models.Todo, error)
 	Add(ctx context.Context, todo models.Base) (models.Todo, error)
+	AddBatch(ctx context.Context, todos []models.Todo, dedupe []string) ([]models.Todo, []int, error)
+	Duplicates(ctx context.Context, todos []models.Todo, dedupe []string) ([]int, error)
 	SetStatus(ctx context.Context, id int, status models.Status) error
 	Delete(ctx context.Context, id int) error
+	History(ctx context.Context, id int) ([]models.TodoVersion, error)
+	Revert(ctx context.Context, id int, version int, expected int) (models.Todo, error)
+	Stats(ctx context.Context) ([]models.PriorityStats, error)
 }
@@ -2,75 +2,424 @@ package database
 
 import (
 	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+	"todo-api/app/config"
 	"todo-api/app/models"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/plugin/opentelemetry/tracing"
 )
 
+// batchSize is the number of rows per INSERT statement of batch inserts.
+const batchSize = 100
+
+// importLock is the key of the advisory lock that prevents batches skipping
+// duplicates from being inserted at the same time, as they would not see the
+// TODOs added by each other.
+const importLock = 7_461_657_236
+
 type DB struct {
-	dsn string
-	cli *gorm.DB
+	dsn   string
+	cfg   config.Database
+	cli   *gorm.DB
+	stats prometheus.Collector
+}
+
+func New(cfg config.Database) TodoDB {
+	return NewDB(cfg)
 }
 
-func New() TodoDB {
+func NewDB(cfg config.Database) *DB {
 	return &DB{
-		dsn: getDSN(),
+		dsn: getDSN(cfg),
+		cfg: cfg,
 	}
 }
 
+// Init connects to the database and, unless disabled, applies the pending
+// migrations. It can be called again after a failure.
 func (db *DB) Init() error {
+	if err := db.Connect(); err != nil {
+		return err
+	}
+	if db.cfg.AutoMigrate {
+		if _, err := db.MigrateUp(context.Background()); err != nil {
+			db.Shutdown()
+			db.cli = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// Connect opens the connection pool without touching the schema.
+func (db *DB) Connect() error {
+	slog.Debug("connecting to the database", slog.String("dsn", RedactDSN(db.dsn)))
 	var err error
-	if db.cli, err = gorm.Open(postgres.Open(db.dsn), &gorm.Config{}); err != nil {
+	if db.cli, err = gorm.Open(postgres.Open(db.dsn), &gorm.Config{Logger: newLogger()}); err != nil {
+		db.cli = nil
 		return err
 	}
-	if err = db.cli.AutoMigrate(&models.Todo{}); err != nil {
+	if err = db.setup(); err != nil {
+		db.Shutdown()
+		db.cli = nil
 		return err
 	}
-	if err := db.cli.Use(tracing.NewPlugin()); err != nil {
+	return nil
+}
+
+func (db *DB) setup() error {
+	if err := db.configurePool(); err != nil {
+		return err
+	}
+	return db.cli.Use(tracing.NewPlugin())
+}
+
+func (db *DB) configurePool() error {
+	sqlDB, err := db.cli.DB()
+	if err != nil {
 		return err
 	}
+	sqlDB.SetMaxOpenConns(db.cfg.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(db.cfg.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(db.cfg.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(db.cfg.ConnMaxIdleTime)
+	db.stats = collectors.NewDBStatsCollector(sqlDB, "todo")
 	return nil
 }
 
 func (db *DB) Shutdown() {
+	if db.cli == nil {
+		return
+	}
+	if sqlDB, err := db.cli.DB(); err == nil {
+		if err := sqlDB.Close(); err != nil {
+			slog.Warn("cannot close database", slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (db *DB) Ping(ctx context.Context) error {
+	if db.cli == nil {
+		return ErrorNotConnected
+	}
+	sqlDB, err := db.cli.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
 }
 
-func (db *DB) GetAll(ctx context.Context) ([]models.Todo, error) {
+// Describe sends no descriptors, as the connection pool statistics are only
+// known after Init.
+func (db *DB) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// Collect exposes the statistics of the connection pool.
+func (db *DB) Collect(ch chan<- prometheus.Metric) {
+	if db.stats != nil {
+		db.stats.Collect(ch)
+	}
+}
+
+// filtered selects the TODOs matching the filter, by order of creation.
+func (db *DB) filtered(ctx context.Context, filter Filter) *gorm.DB {
+	tx := db.cli.WithContext(ctx).Model(&models.Todo{})
+	if filter.Completed != nil {
+		tx = tx.Where("completed = ?", *filter.Completed)
+	}
+	if filter.Priority > 0 {
+		tx = tx.Where("priority = ?", filter.Priority)
+	}
+	if filter.DueBefore != nil {
+		tx = tx.Where("due_at < ?", *filter.DueBefore)
+	}
+	if filter.DueAfter != nil {
+		tx = tx.Where("due_at >= ?", *filter.DueAfter)
+	}
+	if filter.Query != "" {
+		tx = tx.Where("title ILIKE ? ESCAPE '\\'", "%"+likeEscaper.Replace(filter.Query)+"%")
+	}
+	return tx.Order("id")
+}
+
+func (db *DB) GetAll(ctx context.Context, filter Filter) ([]models.Todo, error) {
 	todos := make([]models.Todo, 0)
-	err := db.cli.WithContext(ctx).Find(&todos).Error
+	err := db.filtered(ctx, filter).Find(&todos).Error
 	return todos, err
 }
 
+// Each calls fn with the TODOs matching the filter one at a time, as they
+// are read from the database, stopping at the first error.
+func (db *DB) Each(ctx context.Context, filter Filter, fn func(models.Todo) error) error {
+	tx := db.filtered(ctx, filter)
+	rows, err := tx.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		todo := models.Todo{}
+		if err := tx.ScanRows(rows, &todo); err != nil {
+			return err
+		}
+		if err := fn(todo); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
 func (db *DB) Get(ctx context.Context, id int) (models.Todo, error) {
 	todo := models.Todo{}
 	err := db.cli.WithContext(ctx).First(&todo, id).Error
-	if err == gorm.ErrRecordNotFound {
-		err = ErrorNotFound
-	}
-	return todo, err
+	return todo, notFound(err)
 }
 
 func (db *DB) Add(ctx context.Context, todo models.Base) (models.Todo, error) {
-	dbtodo := models.Todo{Base: todo}
-	err := db.cli.WithContext(ctx).Create(&dbtodo).Error
+	dbtodo := models.Todo{Base: todo, Version: 1}
+	err := db.cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&dbtodo).Error; err != nil {
+			return err
+		}
+		snapshot := models.NewTodoVersion(dbtodo)
+		return tx.Create(&snapshot).Error
+	})
+	if err == nil {
+		todosCreated.Inc()
+	}
 	return dbtodo, err
 }
 
+// AddBatch inserts the TODOs in a single transaction, so that either all of
+// them or none are added. Only their content and completion status are used.
+// When fields are given, the TODOs duplicating a stored TODO or an earlier
+// one of the batch are skipped, and their indexes returned.
+func (db *DB) AddBatch(ctx context.Context, todos []models.Todo, fields []string) ([]models.Todo, []int, error) {
+	if len(todos) == 0 {
+		return []models.Todo{}, nil, nil
+	}
+	var dups []int
+	dbtodos := make([]models.Todo, 0, len(todos))
+	err := db.cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if len(fields) > 0 {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", importLock).Error; err != nil {
+				return err
+			}
+			var err error
+			if dups, err = duplicates(tx, todos, fields); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		for i, todo := range todos {
+			if slices.Contains(dups, i) {
+				continue
+			}
+			dbtodo := models.Todo{Base: todo.Base, Version: 1}
+			dbtodo.SetCompleted(todo.Completed, now)
+			dbtodos = append(dbtodos, dbtodo)
+		}
+		if len(dbtodos) == 0 {
+			return nil
+		}
+		if err := tx.CreateInBatches(&dbtodos, batchSize).Error; err != nil {
+			return err
+		}
+		snapshots := make([]models.TodoVersion, len(dbtodos))
+		for i, todo := range dbtodos {
+			snapshots[i] = models.NewTodoVersion(todo)
+		}
+		return tx.CreateInBatches(&snapshots, batchSize).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	todosCreated.Add(float64(len(dbtodos)))
+	return dbtodos, dups, nil
+}
+
+// Duplicates returns the indexes of the TODOs duplicating a stored TODO or
+// an earlier one of the list, without inserting them.
+func (db *DB) Duplicates(ctx context.Context, todos []models.Todo, fields []string) ([]int, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return duplicates(db.cli.WithContext(ctx), todos, fields)
+}
+
+// duplicates compares the TODOs on the fields, as DedupeKey does. Only the
+// stored TODOs sharing the values of the fields with the list are read, a
+// batch at a time.
+func duplicates(tx *gorm.DB, todos []models.Todo, fields []string) ([]int, error) {
+	seen := make(map[string]bool)
+	for start := 0; start < len(todos); start += batchSize {
+		batch := todos[start:min(start+batchSize, len(todos))]
+		query := tx.Model(&models.Todo{})
+		for _, field := range fields {
+			query = dedupeCondition(query, field, batch)
+		}
+		stored := make([]models.Todo, 0)
+		if err := query.Find(&stored).Error; err != nil {
+			return nil, err
+		}
+		for _, todo := range stored {
+			seen[DedupeKey(todo, fields)] = true
+		}
+	}
+	var dups []int
+	for i, todo := range todos {
+		key := DedupeKey(todo, fields)
+		if seen[key] {
+			dups = append(dups, i)
+		}
+		seen[key] = true
+	}
+	return dups, nil
+}
+
+// dedupeCondition restricts the query to the TODOs whose field has one of the
+// values of the batch, normalized like DedupeKey.
+func dedupeCondition(query *gorm.DB, field string, batch []models.Todo) *gorm.DB {
+	values := make([]any, 0, len(batch))
+	null := false
+	for _, todo := range batch {
+		switch field {
+		case "title":
+			values = append(values, strings.ToLower(strings.Trim(todo.Title, " ")))
+		case "description":
+			values = append(values, strings.Trim(todo.Description, " "))
+		case "priority":
+			values = append(values, max(todo.Priority, 1))
+		case "due_at":
+			if todo.DueAt == nil {
+				null = true
+			} else {
+				values = append(values, todo.DueAt.UTC())
+			}
+		}
+	}
+	switch field {
+	case "title":
+		return query.Where("LOWER(TRIM(title)) IN ?", values)
+	case "description":
+		return query.Where("TRIM(COALESCE(description, '')) IN ?", values)
+	case "priority":
+		return query.Where("priority IN ?", values)
+	}
+	switch {
+	case null && len(values) > 0:
+		return query.Where("due_at IN ? OR due_at IS NULL", values)
+	case null:
+		return query.Where("due_at IS NULL")
+	}
+	return query.Where("due_at IN ?", values)
+}
+
 func (db *DB) SetStatus(ctx context.Context, id int, status models.Status) error {
-	if todo, err := db.Get(ctx, id); err == nil {
-		todo.Completed = status.Completed
-		return db.cli.WithContext(ctx).Save(todo).Error
-	} else {
-		return err
+	todo := models.Todo{}
+	completed := false
+	err := db.cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&todo, id).Error; err != nil {
+			return notFound(err)
+		}
+		completed = todo.SetCompleted(status.Completed, time.Now())
+		return saveVersion(tx, &todo)
+	})
+	if err == nil && completed {
+		observeCompleted(todo)
 	}
+	return err
 }
 
 func (db *DB) Delete(ctx context.Context, id int) error {
 	if todo, err := db.Get(ctx, id); err == nil {
-		return db.cli.WithContext(ctx).Delete(todo).Error
+		return db.cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("todo_id = ?", todo.ID).Delete(&models.TodoVersion{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(todo).Error
+		})
 	} else {
 		return err
 	}
 }
+
+func (db *DB) History(ctx context.Context, id int) ([]models.TodoVersion, error) {
+	if _, err := db.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	versions := make([]models.TodoVersion, 0)
+	err := db.cli.WithContext(ctx).Where("todo_id = ?", id).Order("version").Find(&versions).Error
+	return versions, err
+}
+
+// Revert restores the content of a TODO to the given version, recording the
+// result as a new version. When expected is greater than zero, the TODO must
+// still be at that version or ErrorConflict is returned.
+func (db *DB) Revert(ctx context.Context, id int, version int, expected int) (models.Todo, error) {
+	todo := models.Todo{}
+	completed := false
+	err := db.cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&todo, id).Error; err != nil {
+			return notFound(err)
+		}
+		if expected > 0 && todo.Version != expected {
+			return ErrorConflict
+		}
+		snapshot := models.TodoVersion{}
+		if err := tx.Where("todo_id = ? AND version = ?", id, version).First(&snapshot).Error; err != nil {
+			return notFound(err)
+		}
+		todo.Base = snapshot.Base
+		completed = todo.SetCompleted(snapshot.Completed, time.Now())
+		return saveVersion(tx, &todo)
+	})
+	if err == nil && completed {
+		observeCompleted(todo)
+	}
+	return todo, err
+}
+
+// Stats counts the TODOs by priority in a single query.
+func (db *DB) Stats(ctx context.Context) ([]models.PriorityStats, error) {
+	stats := make([]models.PriorityStats, 0)
+	err := db.cli.WithContext(ctx).Model(&models.Todo{}).
+		Select("priority, " +
+			"count(*) FILTER (WHERE NOT completed) AS open, " +
+			"count(*) FILTER (WHERE completed) AS completed, " +
+			"count(*) FILTER (WHERE NOT completed AND due_at < now()) AS overdue").
+		Group("priority").
+		Order("priority").
+		Scan(&stats).Error
+	return stats, err
+}
+
+// saveVersion updates the TODO only if nobody else modified it since it was
+// read, and records a snapshot of the new version.
+func saveVersion(tx *gorm.DB, todo *models.Todo) error {
+	current := todo.Version
+	todo.Version++
+	result := tx.Model(todo).Where("version = ?", current).Select("*").Updates(todo)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrorConflict
+	}
+	snapshot := models.NewTodoVersion(*todo)
+	return tx.Create(&snapshot).Error
+}
+
+func notFound(err error) error {
+	if err == gorm.ErrRecordNotFound {
+		return ErrorNotFound
+	}
+	return err
+}
@@ -3,9 +3,12 @@ package database
 import (
 	"context"
 	"testing"
+	"time"
+	"todo-api/app/config"
 	"todo-api/app/models"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -25,17 +28,132 @@ func initMockDatabase() (*gorm.DB, sqlmock.Sqlmock) {
 	return db, mockObj
 }
 
+func TestAddBatch(t *testing.T) {
+	cli, mock := initMockDatabase()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO "todos" .* VALUES \(.*\),\(.*\) RETURNING .*`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	mock.ExpectQuery(`INSERT INTO "todo_versions" .* VALUES \(.*\),\(.*\) RETURNING .*`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	mock.ExpectCommit()
+
+	db := &DB{cli: cli}
+	todos, dups, err := db.AddBatch(context.Background(), []models.Todo{
+		{Base: models.Base{Title: "First"}},
+		{Base: models.Base{Title: "Second"}, Completed: true},
+	}, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(dups))
+	assert.Equal(t, 2, len(todos))
+	assert.Equal(t, 2, todos[1].ID)
+	assert.Equal(t, 1, todos[1].Version)
+	assert.Assert(t, todos[1].CompletedAt != nil)
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
+
+func TestAddBatchRollback(t *testing.T) {
+	cli, mock := initMockDatabase()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO "todos" .* RETURNING .*`).WillReturnError(gorm.ErrInvalidData)
+	mock.ExpectRollback()
+
+	db := &DB{cli: cli}
+	_, _, err := db.AddBatch(context.Background(), []models.Todo{{Base: models.Base{Title: "First"}}}, nil)
+	assert.Equal(t, gorm.ErrInvalidData, err)
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
+
+func TestAddBatchDedupe(t *testing.T) {
+	cli, mock := initMockDatabase()
+	mock.ExpectBegin()
+	// The lookup happens in the transaction, after other imports are done
+	mock.ExpectExec(`^SELECT pg_advisory_xact_lock`).WithArgs(importLock).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`^SELECT \* FROM "todos" WHERE LOWER\(TRIM\(title\)\) IN \(\$1,\$2,\$3\)`).
+		WithArgs("buy milk", "call mom", "call mom").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "Buy milk "))
+	mock.ExpectQuery(`INSERT INTO "todos" .* VALUES \([^)]*\) RETURNING .*`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectQuery(`INSERT INTO "todo_versions" .* RETURNING .*`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	db := &DB{cli: cli}
+	todos, dups, err := db.AddBatch(context.Background(), []models.Todo{
+		{Base: models.Base{Title: "buy milk"}},
+		{Base: models.Base{Title: "Call mom"}},
+		{Base: models.Base{Title: "call mom"}},
+	}, []string{"title"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []int{0, 2}, dups)
+	assert.Equal(t, 1, len(todos))
+	assert.Equal(t, "Call mom", todos[0].Title)
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
+
+func TestDuplicates(t *testing.T) {
+	due := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	cli, mock := initMockDatabase()
+	mock.ExpectQuery(`^SELECT \* FROM "todos" WHERE priority IN \(\$1,\$2\) AND \(due_at IN \(\$3\) OR due_at IS NULL\)`).
+		WithArgs(1, 2, due).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "priority", "due_at"}).AddRow(1, 2, due))
+
+	db := &DB{cli: cli}
+	dups, err := db.Duplicates(context.Background(), []models.Todo{
+		{Base: models.Base{Title: "Buy milk"}},
+		{Base: models.Base{Title: "Call mom", Priority: 2, DueAt: &due}},
+	}, []string{"priority", "due_at"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []int{1}, dups)
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
+
 func TestGetAll(t *testing.T) {
 	cli, mock := initMockDatabase()
 	rows := sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "Pass the test")
 	mock.ExpectQuery(`^SELECT .*`).WillReturnRows(rows)
 
 	db := &DB{cli: cli}
-	todos, err := db.GetAll(context.Background())
+	todos, err := db.GetAll(context.Background(), Filter{})
 	assert.NilError(t, err)
 	assert.Equal(t, 1, len(todos))
 }
 
+func TestGetAllFiltered(t *testing.T) {
+	cli, mock := initMockDatabase()
+	rows := sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "Write the 100% report")
+	mock.ExpectQuery(`^SELECT \* FROM "todos" WHERE completed = \$1 AND priority = \$2 AND title ILIKE \$3 .* ORDER BY id`).
+		WithArgs(false, 2, `%100\%%`).
+		WillReturnRows(rows)
+
+	db := &DB{cli: cli}
+	completed := false
+	todos, err := db.GetAll(context.Background(), Filter{Completed: &completed, Priority: 2, Query: "100%"})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(todos))
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
+
+func TestEach(t *testing.T) {
+	cli, mock := initMockDatabase()
+	rows := sqlmock.NewRows([]string{"id", "title"}).
+		AddRow(1, "First").
+		AddRow(2, "Second").
+		AddRow(3, "Third")
+	mock.ExpectQuery(`^SELECT \* FROM "todos" ORDER BY id`).WillReturnRows(rows)
+
+	db := &DB{cli: cli}
+	var titles []string
+	err := db.Each(context.Background(), Filter{}, func(todo models.Todo) error {
+		titles = append(titles, todo.Title)
+		if len(titles) == 2 {
+			return ErrorConflict
+		}
+		return nil
+	})
+	assert.Equal(t, ErrorConflict, err)
+	assert.DeepEqual(t, []string{"First", "Second"}, titles)
+}
+
 func TestGet(t *testing.T) {
 	cli, mock := initMockDatabase()
 	rows := sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "Pass the test")
@@ -60,30 +178,56 @@ func TestGetNotFound(t *testing.T) {
 
 func TestAdd(t *testing.T) {
 	cli, mock := initMockDatabase()
-	mock.ExpectQuery(`INSERT .* RETURNING .*`).
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO "todos" .* RETURNING .*`).
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`INSERT INTO "todo_versions" .* RETURNING .*`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
 
 	db := &DB{cli: cli}
 
 	todo, err := db.Add(context.Background(), models.Base{Title: "Testing"})
 	assert.NilError(t, err)
 	assert.Equal(t, 1, todo.ID)
+	assert.Equal(t, 1, todo.Version)
+	assert.NilError(t, mock.ExpectationsWereMet())
 }
 
 func TestSetStatus(t *testing.T) {
 	cli, mock := initMockDatabase()
-	rows := sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "Pass the test")
+	rows := sqlmock.NewRows([]string{"id", "title", "version"}).AddRow(1, "Pass the test", 1)
+	mock.ExpectBegin()
 	mock.ExpectQuery(`^SELECT . FROM "todos" WHERE "todos"."id" .*`).WillReturnRows(rows)
-	mock.ExpectExec(`^UPDATE .*`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`^UPDATE "todos" SET .* WHERE version = .*`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`INSERT INTO "todo_versions" .* RETURNING .*`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectCommit()
 	db := &DB{cli: cli}
 
 	err := db.SetStatus(context.Background(), 1, models.Status{Completed: true})
 	assert.NilError(t, err)
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetStatusConflict(t *testing.T) {
+	cli, mock := initMockDatabase()
+	rows := sqlmock.NewRows([]string{"id", "title", "version"}).AddRow(1, "Pass the test", 1)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT . FROM "todos" WHERE "todos"."id" .*`).WillReturnRows(rows)
+	mock.ExpectExec(`^UPDATE "todos" SET .* WHERE version = .*`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	db := &DB{cli: cli}
+
+	err := db.SetStatus(context.Background(), 1, models.Status{Completed: true})
+	assert.Equal(t, ErrorConflict, err)
 }
 
 func TestSetStatusNotFound(t *testing.T) {
 	cli, mock := initMockDatabase()
+	mock.ExpectBegin()
 	mock.ExpectQuery(`^SELECT . FROM "todos" WHERE "todos"."id" .*`).WillReturnError(gorm.ErrRecordNotFound)
+	mock.ExpectRollback()
 	db := &DB{cli: cli}
 
 	err := db.SetStatus(context.Background(), 1, models.Status{Completed: true})
@@ -94,7 +238,10 @@ func TestDelete(t *testing.T) {
 	cli, mock := initMockDatabase()
 	rows := sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "Pass the test")
 	mock.ExpectQuery(`^SELECT . FROM "todos" WHERE "todos"."id" .*`).WillReturnRows(rows)
-	mock.ExpectExec(`^DELETE .*`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(`^DELETE FROM "todo_versions" .*`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`^DELETE FROM "todos" .*`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 	db := &DB{cli: cli}
 
 	err := db.Delete(context.Background(), 1)
@@ -109,3 +256,91 @@ func TestDeleteNotFound(t *testing.T) {
 	err := db.Delete(context.Background(), 1)
 	assert.Equal(t, ErrorNotFound, err)
 }
+
+func TestHistory(t *testing.T) {
+	cli, mock := initMockDatabase()
+	rows := sqlmock.NewRows([]string{"id", "title", "version"}).AddRow(1, "Pass the test", 2)
+	mock.ExpectQuery(`^SELECT . FROM "todos" WHERE "todos"."id" .*`).WillReturnRows(rows)
+	versions := sqlmock.NewRows([]string{"todo_id", "version", "title"}).
+		AddRow(1, 1, "Pass the test").
+		AddRow(1, 2, "Pass the test")
+	mock.ExpectQuery(`^SELECT . FROM "todo_versions" WHERE todo_id = .* ORDER BY version`).WillReturnRows(versions)
+	db := &DB{cli: cli}
+
+	history, err := db.History(context.Background(), 1)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(history))
+	assert.Equal(t, 2, history[1].Version)
+}
+
+func TestHistoryNotFound(t *testing.T) {
+	cli, mock := initMockDatabase()
+	mock.ExpectQuery(`^SELECT . FROM "todos" WHERE "todos"."id" .*`).WillReturnError(gorm.ErrRecordNotFound)
+	db := &DB{cli: cli}
+
+	_, err := db.History(context.Background(), 1)
+	assert.Equal(t, ErrorNotFound, err)
+}
+
+func TestRevert(t *testing.T) {
+	cli, mock := initMockDatabase()
+	rows := sqlmock.NewRows([]string{"id", "title", "completed", "version"}).AddRow(1, "Pass the test", true, 2)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT . FROM "todos" WHERE "todos"."id" .*`).WillReturnRows(rows)
+	versions := sqlmock.NewRows([]string{"todo_id", "version", "title", "completed"}).AddRow(1, 1, "Pass the test", false)
+	mock.ExpectQuery(`^SELECT . FROM "todo_versions" WHERE todo_id = .* AND version = .*`).WillReturnRows(versions)
+	mock.ExpectExec(`^UPDATE "todos" SET .* WHERE version = .*`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`INSERT INTO "todo_versions" .* RETURNING .*`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectCommit()
+	db := &DB{cli: cli}
+
+	todo, err := db.Revert(context.Background(), 1, 1, 2)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, todo.Version)
+	assert.Assert(t, todo.Completed == false)
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevertConflict(t *testing.T) {
+	cli, mock := initMockDatabase()
+	rows := sqlmock.NewRows([]string{"id", "title", "version"}).AddRow(1, "Pass the test", 3)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT . FROM "todos" WHERE "todos"."id" .*`).WillReturnRows(rows)
+	mock.ExpectRollback()
+	db := &DB{cli: cli}
+
+	_, err := db.Revert(context.Background(), 1, 1, 2)
+	assert.Equal(t, ErrorConflict, err)
+}
+
+func TestStats(t *testing.T) {
+	cli, mock := initMockDatabase()
+	rows := sqlmock.NewRows([]string{"priority", "open", "completed", "overdue"}).
+		AddRow(1, 3, 2, 1).
+		AddRow(2, 1, 0, 0)
+	mock.ExpectQuery(`^SELECT priority, count\(\*\) FILTER .* FROM "todos" GROUP BY "priority"`).WillReturnRows(rows)
+	db := &DB{cli: cli}
+
+	stats, err := db.Stats(context.Background())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []models.PriorityStats{
+		{Priority: 1, Open: 3, Completed: 2, Overdue: 1},
+		{Priority: 2, Open: 1},
+	}, stats)
+}
+
+func TestConfigurePool(t *testing.T) {
+	cli, mock := initMockDatabase()
+	db := &DB{cli: cli, cfg: config.Database{MaxOpenConns: 7, MaxIdleConns: 3}}
+	assert.NilError(t, db.configurePool())
+
+	sqlDB, err := cli.DB()
+	assert.NilError(t, err)
+	assert.Equal(t, 7, sqlDB.Stats().MaxOpenConnections)
+	assert.Assert(t, testutil.CollectAndCount(db, "go_sql_max_open_connections") == 1)
+
+	mock.ExpectClose()
+	db.Shutdown()
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// slowQuery is the duration above which queries are logged as warnings.
+const slowQuery = 200 * time.Millisecond
+
+// slogLogger sends GORM logs through slog, keeping the context so records
+// can be correlated with the request and trace that issued the query.
+type slogLogger struct {
+	level logger.LogLevel
+}
+
+func newLogger() logger.Interface {
+	return &slogLogger{level: logger.Warn}
+}
+
+func (l *slogLogger) LogMode(level logger.LogLevel) logger.Interface {
+	return &slogLogger{level: level}
+}
+
+func (l *slogLogger) Info(ctx context.Context, msg string, args ...any) {
+	if l.level >= logger.Info {
+		slog.InfoContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *slogLogger) Warn(ctx context.Context, msg string, args ...any) {
+	if l.level >= logger.Warn {
+		slog.WarnContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *slogLogger) Error(ctx context.Context, msg string, args ...any) {
+	if l.level >= logger.Error {
+		slog.ErrorContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *slogLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.level <= logger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= logger.Error:
+		sql, rows := fc()
+		slog.ErrorContext(ctx, "query failed", slog.String("sql", sql), slog.Int64("rows", rows),
+			slog.Duration("duration", elapsed), slog.String("error", err.Error()))
+	case elapsed > slowQuery && l.level >= logger.Warn:
+		sql, rows := fc()
+		slog.WarnContext(ctx, "slow query", slog.String("sql", sql), slog.Int64("rows", rows),
+			slog.Duration("duration", elapsed))
+	case l.level >= logger.Info:
+		sql, rows := fc()
+		slog.DebugContext(ctx, "query executed", slog.String("sql", sql), slog.Int64("rows", rows),
+			slog.Duration("duration", elapsed))
+	}
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+	"todo-api/app/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	todosCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "todos_created_total",
+		Help: "Total number of TODOs created",
+	})
+	todosCompleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "todos_completed_total",
+		Help: "Total number of TODOs marked as completed",
+	})
+	completionTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "todo_completion_seconds",
+		Help:    "Time (in seconds) from the creation of a TODO until it is completed",
+		Buckets: []float64{60, 300, 900, 3600, 4 * 3600, 12 * 3600, 86400, 3 * 86400, 7 * 86400, 30 * 86400},
+	})
+	todosDesc = prometheus.NewDesc("todos",
+		"Number of TODOs by priority and status", []string{"priority", "status"}, nil)
+	overdueDesc = prometheus.NewDesc("todos_overdue",
+		"Number of open TODOs past their due date by priority", []string{"priority"}, nil)
+)
+
+func observeCompleted(todo models.Todo) {
+	todosCompleted.Inc()
+	if todo.CompletedAt != nil && !todo.CreatedAt.IsZero() {
+		completionTime.Observe(todo.CompletedAt.Sub(todo.CreatedAt).Seconds())
+	}
+}
+
+// Collector exposes usage metrics about the TODOs. The counts are computed by
+// the database and cached, so frequent scrapes don't overload it.
+type Collector struct {
+	db         TodoDB
+	ttl        time.Duration
+	timeout    time.Duration
+	mu         sync.Mutex
+	stats      []models.PriorityStats
+	updated    time.Time
+	refreshing bool
+}
+
+func NewCollector(db TodoDB, ttl time.Duration) *Collector {
+	return &Collector{db: db, ttl: ttl, timeout: 5 * time.Second}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	todosCreated.Describe(ch)
+	todosCompleted.Describe(ch)
+	completionTime.Describe(ch)
+	ch <- todosDesc
+	ch <- overdueDesc
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	todosCreated.Collect(ch)
+	todosCompleted.Collect(ch)
+	completionTime.Collect(ch)
+	for _, s := range c.getStats() {
+		priority := strconv.Itoa(s.Priority)
+		ch <- prometheus.MustNewConstMetric(todosDesc, prometheus.GaugeValue, float64(s.Open), priority, "open")
+		ch <- prometheus.MustNewConstMetric(todosDesc, prometheus.GaugeValue, float64(s.Completed), priority, "completed")
+		ch <- prometheus.MustNewConstMetric(overdueDesc, prometheus.GaugeValue, float64(s.Overdue), priority)
+	}
+}
+
+// getStats returns the cached counts, refreshing them when they are stale. The
+// query runs without the lock, and only for one scrape at a time, so scrapes
+// don't queue up behind a slow database but get the previous counts.
+func (c *Collector) getStats() []models.PriorityStats {
+	c.mu.Lock()
+	if c.refreshing || c.stats != nil && time.Since(c.updated) < c.ttl {
+		defer c.mu.Unlock()
+		return c.stats
+	}
+	c.refreshing = true
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	stats, err := c.db.Stats(ctx)
+	cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshing = false
+	if err != nil {
+		slog.Warn("cannot compute TODO statistics", slog.String("error", err.Error()))
+		return c.stats
+	}
+	c.stats = stats
+	c.updated = time.Now()
+	return stats
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"todo-api/app/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"gotest.tools/v3/assert"
+)
+
+func TestCollector(t *testing.T) {
+	cli, mock := initMockDatabase()
+	rows := sqlmock.NewRows([]string{"priority", "open", "completed", "overdue"}).
+		AddRow(1, 3, 2, 1)
+	mock.ExpectQuery(`^SELECT priority, .* FROM "todos" GROUP BY "priority"`).WillReturnRows(rows)
+	collector := NewCollector(&DB{cli: cli}, time.Minute)
+
+	expected := `
+# HELP todos Number of TODOs by priority and status
+# TYPE todos gauge
+todos{priority="1",status="completed"} 2
+todos{priority="1",status="open"} 3
+# HELP todos_overdue Number of open TODOs past their due date by priority
+# TYPE todos_overdue gauge
+todos_overdue{priority="1"} 1
+`
+	assert.NilError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), "todos", "todos_overdue"))
+	// The second scrape is served from the cache
+	assert.NilError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), "todos", "todos_overdue"))
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
+
+// slowDB answers the statistics query once released.
+type slowDB struct {
+	TodoDB
+	started chan struct{}
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (db *slowDB) Stats(ctx context.Context) ([]models.PriorityStats, error) {
+	db.calls.Add(1)
+	db.started <- struct{}{}
+	<-db.release
+	return []models.PriorityStats{{Priority: 1, Open: 4}}, nil
+}
+
+func TestCollectorSlowDatabase(t *testing.T) {
+	db := &slowDB{started: make(chan struct{}, 1), release: make(chan struct{})}
+	collector := NewCollector(db, time.Minute)
+	collector.stats = []models.PriorityStats{{Priority: 1, Open: 3}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		testutil.CollectAndCount(collector, "todos")
+	}()
+	<-db.started
+
+	// Scrapes during the refresh get the stale counts without waiting
+	expected := `
+# HELP todos Number of TODOs by priority and status
+# TYPE todos gauge
+todos{priority="1",status="completed"} 0
+todos{priority="1",status="open"} 3
+`
+	scraped := make(chan error, 1)
+	go func() {
+		scraped <- testutil.CollectAndCompare(collector, strings.NewReader(expected), "todos")
+	}()
+	select {
+	case err := <-scraped:
+		assert.NilError(t, err)
+	case <-time.After(5 * time.Second):
+		close(db.release)
+		t.Fatal("the scrape waited for the refresh")
+	}
+	close(db.release)
+	<-done
+	assert.NilError(t, testutil.CollectAndCompare(collector, strings.NewReader(strings.Replace(expected, "} 3", "} 4", 1)), "todos"))
+	assert.Equal(t, int32(1), db.calls.Load())
+}
+
+func TestCompletionMetrics(t *testing.T) {
+	cli, mock := initMockDatabase()
+	created := time.Now().Add(-time.Hour)
+	rows := sqlmock.NewRows([]string{"id", "title", "version", "created_at"}).AddRow(1, "Pass the test", 1, created)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT . FROM "todos" WHERE "todos"."id" .*`).WillReturnRows(rows)
+	mock.ExpectExec(`^UPDATE "todos" SET .* WHERE version = .*`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`INSERT INTO "todo_versions" .* RETURNING .*`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectCommit()
+	db := &DB{cli: cli}
+
+	completed := testutil.ToFloat64(todosCompleted)
+	histogram := &dto.Metric{}
+	assert.NilError(t, completionTime.Write(histogram))
+	samples := histogram.GetHistogram().GetSampleCount()
+
+	assert.NilError(t, db.SetStatus(context.Background(), 1, models.Status{Completed: true}))
+	assert.Equal(t, completed+1, testutil.ToFloat64(todosCompleted))
+	assert.NilError(t, completionTime.Write(histogram))
+	assert.Equal(t, samples+1, histogram.GetHistogram().GetSampleCount())
+	assert.Assert(t, histogram.GetHistogram().GetSampleSum() >= 3600)
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"gotest.tools/v3/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	assert.NilError(t, err)
+	assert.Assert(t, len(migrations) >= 3)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version)
+		assert.Assert(t, m.Up != "" && m.Down != "")
+	}
+	assert.Equal(t, "create_todos", migrations[0].Name)
+}
+
+func TestLoadMigrationsInvalid(t *testing.T) {
+	_, err := loadMigrations(fstest.MapFS{
+		"migrations/0001_init.up.sql": {Data: []byte("SELECT 1;")},
+	})
+	assert.ErrorContains(t, err, "must have up and down scripts")
+
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/init.sql": {Data: []byte("SELECT 1;")},
+	})
+	assert.ErrorContains(t, err, "invalid migration file name")
+}
+
+func expectMigrationLock(mock sqlmock.Sqlmock, applied ...int) {
+	mock.ExpectExec(`^SELECT pg_advisory_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`^CREATE TABLE IF NOT EXISTS schema_migrations`).WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"version", "name", "applied_at"})
+	for _, version := range applied {
+		rows.AddRow(version, "migration", time.Now())
+	}
+	mock.ExpectQuery(`^SELECT \* FROM "schema_migrations" ORDER BY version`).WillReturnRows(rows)
+}
+
+func TestMigrateUp(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	assert.NilError(t, err)
+
+	cli, mock := initMockDatabase()
+	expectMigrationLock(mock, 1)
+	for range migrations[1:] {
+		mock.ExpectBegin()
+		mock.ExpectExec(`.+`).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`^INSERT INTO "schema_migrations"`).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}
+	mock.ExpectExec(`^SELECT pg_advisory_unlock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	db := &DB{cli: cli}
+
+	count, err := db.MigrateUp(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, len(migrations)-1, count)
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateUpFailure(t *testing.T) {
+	cli, mock := initMockDatabase()
+	expectMigrationLock(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS todos`).WillReturnError(ErrorNotConnected)
+	mock.ExpectRollback()
+	mock.ExpectExec(`^SELECT pg_advisory_unlock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	db := &DB{cli: cli}
+
+	count, err := db.MigrateUp(context.Background())
+	assert.ErrorContains(t, err, "migration 1_create_todos failed")
+	assert.Equal(t, 0, count)
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrateDown(t *testing.T) {
+	cli, mock := initMockDatabase()
+	expectMigrationLock(mock, 1, 2, 3)
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE todo_versions DROP COLUMN IF EXISTS due_at`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`^DELETE FROM "schema_migrations" WHERE "schema_migrations"."version" = \$1`).
+		WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`^SELECT pg_advisory_unlock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	db := &DB{cli: cli}
+
+	count, err := db.MigrateDown(context.Background(), 1)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, count)
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
+
+func TestPendingMigrations(t *testing.T) {
+	cli, mock := initMockDatabase()
+	mock.ExpectQuery(`^SELECT "version" FROM "schema_migrations"`).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1).AddRow(2))
+	db := &DB{cli: cli}
+
+	pending, err := db.PendingMigrations(context.Background())
+	assert.NilError(t, err)
+	migrations, _ := loadMigrations(migrationFiles)
+	assert.Equal(t, len(migrations)-2, pending)
+}
+
+func TestMigrationStatus(t *testing.T) {
+	cli, mock := initMockDatabase()
+	// Read-only: no lock and no CREATE TABLE
+	mock.ExpectQuery(`^SELECT to_regclass\('schema_migrations'\) IS NOT NULL`).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`^SELECT \* FROM "schema_migrations" ORDER BY version`).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "name", "applied_at"}).AddRow(1, "create_todos", time.Now()))
+	db := &DB{cli: cli}
+
+	status, err := db.MigrationStatus(context.Background())
+	assert.NilError(t, err)
+	migrations, _ := loadMigrations(migrationFiles)
+	assert.Equal(t, len(migrations), len(status))
+	assert.Assert(t, status[0].AppliedAt != nil)
+	assert.Assert(t, status[1].AppliedAt == nil)
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrationStatusNoTable(t *testing.T) {
+	cli, mock := initMockDatabase()
+	mock.ExpectQuery(`^SELECT to_regclass`).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	db := &DB{cli: cli}
+
+	_, err := db.MigrationStatus(context.Background())
+	assert.Equal(t, ErrorNoMigrationsTable, err)
+	assert.NilError(t, mock.ExpectationsWereMet())
+}
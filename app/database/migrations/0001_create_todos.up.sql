@@ -0,0 +1,10 @@
+-- Compatible with the schema created by GORM's AutoMigrate
+CREATE TABLE IF NOT EXISTS todos (
+    id          bigserial PRIMARY KEY,
+    title       text NOT NULL,
+    description text,
+    priority    bigint DEFAULT 1,
+    completed   boolean DEFAULT false,
+    created_at  timestamptz,
+    updated_at  timestamptz
+);
@@ -0,0 +1,20 @@
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1;
+
+CREATE TABLE IF NOT EXISTS todo_versions (
+    id          bigserial PRIMARY KEY,
+    todo_id     bigint NOT NULL,
+    version     bigint NOT NULL,
+    title       text NOT NULL,
+    description text,
+    priority    bigint DEFAULT 1,
+    completed   boolean,
+    created_at  timestamptz
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_todo_version ON todo_versions (todo_id, version);
+
+-- Record the current state of existing TODOs as their first known version
+INSERT INTO todo_versions (todo_id, version, title, description, priority, completed, created_at)
+SELECT id, version, title, description, priority, completed, COALESCE(updated_at, now())
+FROM todos
+ON CONFLICT (todo_id, version) DO NOTHING;
@@ -0,0 +1,3 @@
+ALTER TABLE todo_versions DROP COLUMN IF EXISTS due_at;
+ALTER TABLE todos DROP COLUMN IF EXISTS completed_at;
+ALTER TABLE todos DROP COLUMN IF EXISTS due_at;
@@ -0,0 +1,6 @@
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS due_at timestamptz;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS completed_at timestamptz;
+ALTER TABLE todo_versions ADD COLUMN IF NOT EXISTS due_at timestamptz;
+
+-- The last update is the best approximation for TODOs completed in the past
+UPDATE todos SET completed_at = updated_at WHERE completed AND completed_at IS NULL;
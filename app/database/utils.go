@@ -1,22 +1,127 @@
 package database
 
 import (
-	"fmt"
-	"os"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"todo-api/app/config"
+	"todo-api/app/models"
 )
 
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+// DedupeFields lists the fields that can identify duplicate TODOs.
+var DedupeFields = []string{"title", "description", "priority", "due_at"}
+
+// DedupeKey returns the values of the fields of the TODO, which are among
+// DedupeFields, as a single string. Titles are compared ignoring case, and
+// surrounding spaces are ignored.
+func DedupeKey(todo models.Todo, fields []string) string {
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		switch field {
+		case "title":
+			values[i] = strings.ToLower(strings.Trim(todo.Title, " "))
+		case "description":
+			values[i] = strings.Trim(todo.Description, " ")
+		case "priority":
+			values[i] = strconv.Itoa(max(todo.Priority, 1))
+		case "due_at":
+			if todo.DueAt != nil {
+				values[i] = todo.DueAt.UTC().Format(time.RFC3339Nano)
+			}
+		}
 	}
-	return fallback
+	return strings.Join(values, "\x00")
 }
 
-func getDSN() string {
-	return fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s",
-		getEnv("POSTGRES_HOST", "localhost"),
-		getEnv("POSTGRES_PORT", "5432"),
-		getEnv("POSTGRES_DB", "todo"),
-		getEnv("POSTGRES_USER", "postgres"),
-		getEnv("POSTGRES_PASSWORD", "postgres"))
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// getDSN builds the connection URL from DATABASE_URL, when set, or from the
+// individual settings otherwise, then adds the TLS and timeout parameters.
+func getDSN(cfg config.Database) string {
+	u := &url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(cfg.User, cfg.Password),
+		Path:   "/" + cfg.Name,
+	}
+	q := url.Values{}
+	if strings.HasPrefix(cfg.Host, "/") {
+		// Unix socket directories cannot be part of the authority
+		q.Set("host", cfg.Host)
+		q.Set("port", strconv.Itoa(cfg.Port))
+	} else {
+		u.Host = net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	}
+	if parsed, err := url.Parse(cfg.URL); cfg.URL != "" && err == nil {
+		u, q = parsed, parsed.Query()
+		if cfg.PasswordFile != "" {
+			u.User = url.UserPassword(u.User.Username(), cfg.Password)
+		}
+	}
+
+	for key, value := range map[string]string{
+		"sslmode":     cfg.SSLMode,
+		"sslrootcert": cfg.SSLRootCert,
+		"sslcert":     cfg.SSLCert,
+		"sslkey":      cfg.SSLKey,
+	} {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	if cfg.StatementTimeout > 0 {
+		q.Set("statement_timeout", strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10))
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// RedactDSN hides the password of a connection URL so that it can be logged.
+func RedactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "<invalid DSN>"
+	}
+	q := u.Query()
+	if q.Has("password") {
+		q.Set("password", "xxxxx")
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
+
+// ParseFilter reads a filter from query parameters: completed, priority,
+// due_before, due_after and q.
+func ParseFilter(q url.Values) (Filter, error) {
+	filter := Filter{Query: q.Get("q")}
+	if value := q.Get("completed"); value != "" {
+		completed, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, errors.New("completed: must be true or false")
+		}
+		filter.Completed = &completed
+	}
+	if value := q.Get("priority"); value != "" {
+		priority, err := strconv.Atoi(value)
+		if err != nil || priority < 1 {
+			return filter, errors.New("priority: must be a positive integer")
+		}
+		filter.Priority = priority
+	}
+	for _, due := range []struct {
+		name  string
+		field **time.Time
+	}{{"due_before", &filter.DueBefore}, {"due_after", &filter.DueAfter}} {
+		if value := q.Get(due.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, errors.New(due.name + ": must be an RFC 3339 time")
+			}
+			*due.field = &t
+		}
+	}
+	return filter, nil
 }
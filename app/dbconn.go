@@ -0,0 +1,118 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+	"todo-api/app/config"
+	"todo-api/app/database"
+	"todo-api/app/middleware"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type retryConfig struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	healthInterval  time.Duration
+}
+
+func getRetryConfig(cfg config.Database) retryConfig {
+	return retryConfig{
+		initialInterval: cfg.RetryInitialInterval,
+		maxInterval:     cfg.RetryMaxInterval,
+		healthInterval:  cfg.HealthInterval,
+	}
+}
+
+// backoff returns the time to wait before the given attempt, growing
+// exponentially up to the maximum, with full jitter on the upper half to
+// avoid replicas retrying in sync.
+func (c retryConfig) backoff(attempt int) time.Duration {
+	d := float64(c.initialInterval) * math.Pow(2, float64(attempt))
+	d = math.Min(d, float64(c.maxInterval))
+	return time.Duration(d/2 + rand.Float64()*d/2)
+}
+
+// connectDB initializes the database, retrying until it succeeds or the
+// context is done.
+func (a *App) connectDB(ctx context.Context) bool {
+	for attempt := 0; ; attempt++ {
+		err := a.db.Init()
+		if err == nil {
+			slog.InfoContext(ctx, "connected to the database")
+			a.checkMigrations(ctx)
+			a.obs.Register(database.NewCollector(a.db, a.config.Load().Metrics.StatsTTL))
+			if pool, ok := a.db.(prometheus.Collector); ok {
+				a.obs.Register(pool)
+			}
+			a.dbReady.Store(true)
+			return true
+		}
+		wait := a.retry.backoff(attempt)
+		slog.WarnContext(ctx, "cannot connect to the database",
+			slog.String("error", err.Error()),
+			slog.Int("attempt", attempt+1),
+			slog.Duration("retry", wait))
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+	}
+}
+
+// checkMigrations verifies that the schema is up to date, as migrations can
+// be disabled at startup to be applied separately.
+func (a *App) checkMigrations(ctx context.Context) {
+	pending, err := a.db.PendingMigrations(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "cannot verify migrations", slog.String("error", err.Error()))
+	} else if pending > 0 {
+		slog.WarnContext(ctx, "database schema is outdated", slog.Int("pending", pending))
+	}
+	a.dbMigrated.Store(err == nil && pending == 0)
+}
+
+// monitorDB pings the database periodically, switching the API to degraded
+// mode while it is unreachable.
+func (a *App) monitorDB(ctx context.Context) {
+	ticker := time.NewTicker(a.retry.healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, a.retry.healthInterval)
+			err := a.db.Ping(pingCtx)
+			cancel()
+			if err != nil && a.dbReady.Swap(false) {
+				slog.WarnContext(ctx, "lost connection to the database", slog.String("error", err.Error()))
+			}
+			if err == nil && !a.dbReady.Swap(true) {
+				slog.InfoContext(ctx, "reconnected to the database")
+			}
+			if err == nil && !a.dbMigrated.Load() {
+				a.checkMigrations(ctx)
+			}
+		}
+	}
+}
+
+// requireDB answers with 503 while the database is not reachable.
+func (a *App) requireDB(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.dbReady.Load() {
+			seconds := int(math.Ceil(a.retry.healthInterval.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+			middleware.WriteError(w, r, database.ErrorNotConnected.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
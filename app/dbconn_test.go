@@ -0,0 +1,96 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+// FlakyDB fails to connect a number of times and can lose the connection.
+type FlakyDB struct {
+	MockDB
+	failures atomic.Int32
+	down     atomic.Bool
+}
+
+func (db *FlakyDB) Init() error {
+	if db.failures.Add(-1) >= 0 {
+		return ErrorMockInternal
+	}
+	return db.MockDB.Init()
+}
+
+func (db *FlakyDB) Ping(ctx context.Context) error {
+	if db.down.Load() {
+		return ErrorMockInternal
+	}
+	return nil
+}
+
+func TestBackoff(t *testing.T) {
+	cfg := retryConfig{initialInterval: time.Second, maxInterval: 10 * time.Second}
+	for attempt, limit := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		wait := cfg.backoff(attempt)
+		assert.Assert(t, wait >= limit/2 && wait <= limit, "attempt %d waits %s", attempt, wait)
+	}
+}
+
+func TestRequireDB(t *testing.T) {
+	srv, _ := newMockApp(false)
+	srv.dbReady.Store(false)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/todos", nil)
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	srv.dbReady.Store(true)
+	w = httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestConnectAndMonitorDB(t *testing.T) {
+	srv, _ := newMockApp(false)
+	db := &FlakyDB{}
+	db.failures.Store(2)
+	srv.db = db
+	srv.dbReady.Store(false)
+	srv.retry.healthInterval = 5 * time.Millisecond
+	srv.obs = newTestObserver()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if srv.connectDB(ctx) {
+			srv.monitorDB(ctx)
+		}
+	}()
+
+	ready := func(expected bool) func(poll.LogT) poll.Result {
+		return func(poll.LogT) poll.Result {
+			if srv.dbReady.Load() == expected {
+				return poll.Success()
+			}
+			return poll.Continue("waiting for ready=%v", expected)
+		}
+	}
+	poll.WaitOn(t, ready(true), poll.WithTimeout(time.Second))
+	assert.Equal(t, int32(-1), db.failures.Load())
+
+	db.down.Store(true)
+	poll.WaitOn(t, ready(false), poll.WithTimeout(time.Second))
+	db.down.Store(false)
+	poll.WaitOn(t, ready(true), poll.WithTimeout(time.Second))
+
+	cancel()
+	<-done
+}
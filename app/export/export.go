@@ -0,0 +1,226 @@
+// Package export writes TODOs in formats meant for other tools, one at a
+// time, so that large exports don't have to fit in memory.
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"todo-api/app/models"
+)
+
+const (
+	JSON     = "json"
+	NDJSON   = "ndjson"
+	CSV      = "csv"
+	Markdown = "markdown"
+)
+
+// Formats lists the supported formats.
+var Formats = []string{JSON, NDJSON, CSV, Markdown}
+
+var contentTypes = map[string]string{
+	JSON:     "application/json",
+	NDJSON:   "application/x-ndjson",
+	CSV:      "text/csv; charset=utf-8",
+	Markdown: "text/markdown; charset=utf-8",
+}
+
+var extensions = map[string]string{
+	JSON:     ".json",
+	NDJSON:   ".ndjson",
+	CSV:      ".csv",
+	Markdown: ".md",
+}
+
+// Columns are the fields of the TODOs in the CSV format, in order.
+var Columns = []string{
+	"id", "title", "description", "priority", "completed", "due_at",
+	"completed_at", "created_at", "updated_at", "version",
+}
+
+// Writer writes TODOs to the underlying writer. Close must be called after
+// the last one to complete the document.
+type Writer interface {
+	Write(todo models.Todo) error
+	Close() error
+}
+
+// NewWriter returns a writer for the format, or an error when it is not
+// supported.
+func NewWriter(w io.Writer, format string) (Writer, error) {
+	switch format {
+	case JSON:
+		return &jsonWriter{w: w}, nil
+	case NDJSON:
+		return &ndjsonWriter{enc: json.NewEncoder(w)}, nil
+	case CSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case Markdown:
+		return &markdownWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("unsupported format %q, must be one of %s", format, strings.Join(Formats, ", "))
+}
+
+// ContentType returns the media type of the format.
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// Extension returns the file extension of the format, including the dot.
+func Extension(format string) string {
+	return extensions[format]
+}
+
+// jsonWriter writes an indented array, like json.Encoder with SetIndent.
+type jsonWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (j *jsonWriter) Write(todo models.Todo) error {
+	data, err := json.MarshalIndent(todo, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	sep := ",\n  "
+	if j.count == 0 {
+		sep = "[\n  "
+	}
+	j.count++
+	_, err = fmt.Fprintf(j.w, "%s%s", sep, data)
+	return err
+}
+
+func (j *jsonWriter) Close() error {
+	end := "\n]\n"
+	if j.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(todo models.Todo) error {
+	return n.enc.Encode(todo)
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (c *csvWriter) Write(todo models.Todo) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	return c.w.Write([]string{
+		strconv.Itoa(todo.ID),
+		EscapeFormula(todo.Title),
+		EscapeFormula(todo.Description),
+		strconv.Itoa(todo.Priority),
+		strconv.FormatBool(todo.Completed),
+		formatTime(todo.DueAt),
+		formatTime(todo.CompletedAt),
+		formatTime(&todo.CreatedAt),
+		formatTime(&todo.UpdatedAt),
+		strconv.Itoa(todo.Version),
+	})
+}
+
+// formulaPrefixes start the cells that spreadsheets evaluate as formulas.
+const formulaPrefixes = "=+-@\t\r"
+
+// EscapeFormula prefixes text that spreadsheets would evaluate as a formula
+// with a quote, so that opening an export cannot run the formulas of a title.
+func EscapeFormula(cell string) string {
+	if cell != "" && strings.ContainsRune(formulaPrefixes, rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// UnescapeFormula reverts EscapeFormula.
+func UnescapeFormula(cell string) string {
+	if len(cell) > 1 && cell[0] == '\'' && strings.ContainsRune(formulaPrefixes, rune(cell[1])) {
+		return cell[1:]
+	}
+	return cell
+}
+
+// writeHeader writes the names of the columns once, so that they are there
+// even without TODOs.
+func (c *csvWriter) writeHeader() error {
+	if c.header {
+		return nil
+	}
+	c.header = true
+	return c.w.Write(Columns)
+}
+
+func (c *csvWriter) Close() error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// markdownWriter writes a table meant for status reports.
+type markdownWriter struct {
+	w      io.Writer
+	header bool
+}
+
+var markdownEscaper = strings.NewReplacer("|", `\|`, "\r\n", "<br>", "\n", "<br>")
+
+func (m *markdownWriter) Write(todo models.Todo) error {
+	if err := m.writeHeader(); err != nil {
+		return err
+	}
+	status := "Open"
+	if todo.Completed {
+		status = "Done"
+	}
+	due := ""
+	if todo.DueAt != nil {
+		due = todo.DueAt.Format(time.DateOnly)
+	}
+	_, err := fmt.Fprintf(m.w, "| %d | %s | %s | %d | %s | %s |\n", todo.ID,
+		markdownEscaper.Replace(todo.Title), markdownEscaper.Replace(todo.Description),
+		todo.Priority, status, due)
+	return err
+}
+
+func (m *markdownWriter) writeHeader() error {
+	if m.header {
+		return nil
+	}
+	m.header = true
+	_, err := io.WriteString(m.w, "| ID | Title | Description | Priority | Status | Due |\n"+
+		"| ---: | --- | --- | ---: | --- | --- |\n")
+	return err
+}
+
+func (m *markdownWriter) Close() error {
+	return m.writeHeader()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,100 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"todo-api/app/models"
+
+	"gotest.tools/v3/assert"
+)
+
+var created = time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC)
+
+var todos = []models.Todo{
+	{
+		ID:        1,
+		Base:      models.Base{Title: "Buy milk, eggs", Priority: 2},
+		Version:   1,
+		CreatedAt: created,
+		UpdatedAt: created,
+	},
+	{
+		ID:        2,
+		Base:      models.Base{Title: "Fix a|b", Description: "Line one\nline two", Priority: 1, DueAt: &created},
+		Completed: true,
+		Version:   2,
+		CreatedAt: created,
+		UpdatedAt: created,
+	},
+}
+
+func write(t *testing.T, format string, todos []models.Todo) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, format)
+	assert.NilError(t, err)
+	for _, todo := range todos {
+		assert.NilError(t, w.Write(todo))
+	}
+	assert.NilError(t, w.Close())
+	return buf.String()
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	assert.NilError(t, enc.Encode(todos))
+	assert.Equal(t, buf.String(), write(t, JSON, todos))
+	assert.Equal(t, "[]\n", write(t, JSON, nil))
+}
+
+func TestNDJSON(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(write(t, NDJSON, todos), "\n"), "\n")
+	assert.Equal(t, 2, len(lines))
+	todo := models.Todo{}
+	assert.NilError(t, json.Unmarshal([]byte(lines[1]), &todo))
+	assert.Equal(t, "Fix a|b", todo.Title)
+	assert.Equal(t, "", write(t, NDJSON, nil))
+}
+
+func TestCSV(t *testing.T) {
+	assert.Equal(t, `id,title,description,priority,completed,due_at,completed_at,created_at,updated_at,version
+1,"Buy milk, eggs",,2,false,,,2024-05-01T09:30:00Z,2024-05-01T09:30:00Z,1
+2,Fix a|b,"Line one
+line two",1,true,2024-05-01T09:30:00Z,,2024-05-01T09:30:00Z,2024-05-01T09:30:00Z,2
+`, write(t, CSV, todos))
+	assert.Equal(t, strings.Join(Columns, ",")+"\n", write(t, CSV, nil))
+}
+
+func TestCSVFormula(t *testing.T) {
+	todo := models.Todo{ID: 3, Base: models.Base{Title: `=HYPERLINK("http://example.com")`, Description: "-1+2"}}
+	lines := strings.Split(write(t, CSV, []models.Todo{todo}), "\n")
+	assert.Assert(t, strings.HasPrefix(lines[1], `3,"'=HYPERLINK(""http://example.com"")",'-1+2,`), lines[1])
+
+	for _, cell := range []string{"=1+1", "+1", "-1", "@SUM(A1)", "\tx", "'quoted", "plain", ""} {
+		assert.Equal(t, cell, UnescapeFormula(EscapeFormula(cell)))
+	}
+	assert.Equal(t, "'=1", EscapeFormula("=1"))
+	assert.Equal(t, "'quoted", EscapeFormula("'quoted"))
+}
+
+func TestMarkdown(t *testing.T) {
+	assert.Equal(t, `| ID | Title | Description | Priority | Status | Due |
+| ---: | --- | --- | ---: | --- | --- |
+| 1 | Buy milk, eggs |  | 2 | Open |  |
+| 2 | Fix a\|b | Line one<br>line two | 1 | Done | 2024-05-01 |
+`, write(t, Markdown, todos))
+}
+
+func TestNewWriterUnsupported(t *testing.T) {
+	_, err := NewWriter(&bytes.Buffer{}, "xlsx")
+	assert.ErrorContains(t, err, `unsupported format "xlsx"`)
+	for _, format := range Formats {
+		assert.Assert(t, ContentType(format) != "")
+		assert.Assert(t, Extension(format) != "")
+	}
+}
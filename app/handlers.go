@@ -8,8 +8,18 @@
 package app
 
 import (
-	"encoding/json"
+	"errors"
+	"log/slog"
+	"mime"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"todo-api/app/database"
+	"todo-api/app/export"
+	"todo-api/app/importer"
+	"todo-api/app/middleware"
 	"todo-api/app/models"
 )
 
@@ -17,33 +27,171 @@ import (
 // @Consume json
 // @Produce json
 // @Param   todo body models.Base true "New TODO"
+// @Param   Idempotency-Key header string false "Key to safely retry the request"
 // @Success 201 {object} models.Todo
-// @Failure 500 "Backend error"
+// @Failure 400 {object} models.Error "Invalid TODO"
+// @Failure 409 {object} models.Error "Request with the same key in progress"
+// @Failure 413 {object} models.Error "Request body too large"
+// @Failure 422 {object} models.Error "Key reused with a different request"
+// @Failure 500 {object} models.Error "Backend error"
 // @Router  /api/v1/todos [post]
 func (a *App) addTodoHandler(w http.ResponseWriter, r *http.Request) {
 	base := models.Base{}
-	if err := json.NewDecoder(r.Body).Decode(&base); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !decodeJSON(w, r, &base) {
 		return
 	}
 	if todo, err := a.db.Add(r.Context(), base); err == nil {
 		w.WriteHeader(http.StatusCreated)
 		sendJSON(w, todo)
 	} else {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sendError(w, r, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// @Summary Import TODOs
+// @Description Adds the TODOs of a file in a single transaction. When a row is invalid, nothing is added and the rows are reported with a 422 status.
+// @Accept  plain,json,text/csv,application/x-ndjson
+// @Produce json
+// @Param   format query string true "File format" Enums(csv, ndjson, json, todotxt, taskwarrior)
+// @Param   dry_run query bool false "Validate the file without adding the TODOs"
+// @Param   dedupe query string false "Comma-separated fields identifying duplicates to skip: title, description, priority, due_at"
+// @Param   file body string true "File to import"
+// @Param   Idempotency-Key header string false "Key to safely retry the request"
+// @Success 200 {object} models.ImportResult "Dry run"
+// @Success 201 {object} models.ImportResult
+// @Failure 400 {object} models.Error "Invalid parameters or file"
+// @Failure 413 {object} models.Error "Request body too large"
+// @Failure 422 {object} models.ImportResult "Invalid rows"
+// @Failure 500 {object} models.Error "Backend error"
+// @Router  /api/v1/todos/import [post]
+func (a *App) importTodosHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if !slices.Contains(importer.Formats, format) {
+		sendError(w, r, "Invalid format, must be one of "+strings.Join(importer.Formats, ", "), http.StatusBadRequest)
+		return
+	}
+	dryRun := false
+	if value := q.Get("dry_run"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			sendError(w, r, "Invalid dry_run, must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	fields, err := importer.ParseDedupe(q.Get("dedupe"))
+	if err != nil {
+		sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := importer.Parse(r.Body, format)
+	if err != nil {
+		sendError(w, r, err.Error(), middleware.BodyErrorStatus(err))
+		return
+	}
+	if err := importer.Import(r.Context(), a.db, rows, fields, dryRun); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	result := importer.Summarize(rows)
+	result.DryRun = dryRun
+	status := http.StatusCreated
+	switch {
+	case result.Failed > 0:
+		status = http.StatusUnprocessableEntity
+	case dryRun:
+		status = http.StatusOK
+	}
+	// Set before the status, which sends the headers
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	sendJSON(w, result)
+}
+
 // @Summary Get all the TODOs
 // @Produce json
+// @Param   completed query bool false "Only completed or open TODOs"
+// @Param   priority query int false "Only TODOs with this priority"
+// @Param   due_before query string false "Only TODOs due before this RFC 3339 time"
+// @Param   due_after query string false "Only TODOs due at or after this RFC 3339 time"
+// @Param   q query string false "Only TODOs whose title contains this text"
 // @Success 200 {object} []models.Todo
-// @Failure 500 "Backend error"
+// @Failure 400 {object} models.Error "Invalid filter"
+// @Failure 500 {object} models.Error "Backend error"
 // @Router  /api/v1/todos [get]
 func (a *App) getTodosHandler(w http.ResponseWriter, r *http.Request) {
-	if todos, err := a.db.GetAll(r.Context()); err == nil {
+	filter, err := database.ParseFilter(r.URL.Query())
+	if err != nil {
+		sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if todos, err := a.db.GetAll(r.Context(), filter); err == nil {
 		sendJSON(w, todos)
 	} else {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sendError(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// @Summary Export the TODOs
+// @Description Streams the TODOs as a file, with the same filters as the list.
+// @Produce json,text/csv,text/markdown,application/x-ndjson
+// @Param   format query string false "File format" Enums(csv, ndjson, markdown, json) default(csv)
+// @Param   completed query bool false "Only completed or open TODOs"
+// @Param   priority query int false "Only TODOs with this priority"
+// @Param   due_before query string false "Only TODOs due before this RFC 3339 time"
+// @Param   due_after query string false "Only TODOs due at or after this RFC 3339 time"
+// @Param   q query string false "Only TODOs whose title contains this text"
+// @Success 200 {file} file
+// @Failure 400 {object} models.Error "Invalid format or filter"
+// @Failure 500 {object} models.Error "Backend error"
+// @Router  /api/v1/todos/export [get]
+func (a *App) exportTodosHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := database.ParseFilter(r.URL.Query())
+	if err != nil {
+		sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = export.CSV
+	}
+	out, err := export.NewWriter(w, format)
+	if err != nil {
+		sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h := w.Header()
+	filename := "todos-" + time.Now().Format(time.DateOnly) + export.Extension(format)
+	h.Set("Content-Type", export.ContentType(format))
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	// Large exports would otherwise be cut by the write timeout of the
+	// server, which is instead applied to every TODO
+	rc := http.NewResponseController(w)
+	timeout := a.config.Load().Server.WriteTimeout
+	count := 0
+	err = a.db.Each(r.Context(), filter, func(todo models.Todo) error {
+		if timeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		count++
+		return out.Write(todo)
+	})
+	if err == nil {
+		err = out.Close()
+	}
+	switch {
+	case err == nil:
+	case count == 0:
+		h.Del("Content-Disposition")
+		sendError(w, r, err.Error(), http.StatusInternalServerError)
+	default:
+		// The status was already sent, so the connection is dropped to
+		// keep the client from taking a partial export for a complete one.
+		// The request is still logged and counted by the Observer.
+		slog.ErrorContext(r.Context(), "export failed", slog.Int("written", count), slog.String("error", err.Error()))
+		panic(http.ErrAbortHandler)
 	}
 }
 
@@ -51,15 +199,16 @@ func (a *App) getTodosHandler(w http.ResponseWriter, r *http.Request) {
 // @Produce json
 // @Param   id path int true "TODO ID"
 // @Success 200 {object} models.Todo
-// @Failure 404 "Not found"
-// @Failure 500 "Backend error"
+// @Failure 404 {object} models.Error "Not found"
+// @Failure 500 {object} models.Error "Backend error"
 // @Router  /api/v1/todos/{id} [get]
 func (a *App) getTodoHandler(w http.ResponseWriter, r *http.Request) {
 	if id := getID(w, r); id > 0 {
 		if todo, err := a.db.Get(r.Context(), id); err == nil {
+			setETag(w, todo)
 			sendJSON(w, todo)
 		} else {
-			handleError(w, err)
+			handleError(w, r, err)
 		}
 	}
 }
@@ -69,20 +218,21 @@ func (a *App) getTodoHandler(w http.ResponseWriter, r *http.Request) {
 // @Param   id path int true "TODO ID"
 // @Param   status body models.Status true "TODO Status"
 // @Success 200 {object} models.Todo
-// @Failure 404 "Not found"
-// @Failure 500 "Backend error"
+// @Failure 400 {object} models.Error "Invalid status"
+// @Failure 404 {object} models.Error "Not found"
+// @Failure 413 {object} models.Error "Request body too large"
+// @Failure 500 {object} models.Error "Backend error"
 // @Router  /api/v1/todos/{id} [put]
 func (a *App) updateTodoHandler(w http.ResponseWriter, r *http.Request) {
 	if id := getID(w, r); id > 0 {
 		status := models.Status{}
-		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if !decodeJSON(w, r, &status) {
 			return
 		}
 		if err := a.db.SetStatus(r.Context(), id, status); err == nil {
 			w.WriteHeader(http.StatusNoContent)
 		} else {
-			handleError(w, err)
+			handleError(w, r, err)
 		}
 	}
 }
@@ -91,15 +241,72 @@ func (a *App) updateTodoHandler(w http.ResponseWriter, r *http.Request) {
 // @Produce json
 // @Param   id path int true "TODO ID"
 // @Success 200 {object} models.Todo
-// @Failure 404 "Not found"
-// @Failure 500 "Backend error"
+// @Failure 404 {object} models.Error "Not found"
+// @Failure 500 {object} models.Error "Backend error"
 // @Router  /api/v1/todos/{id} [delete]
 func (a *App) deleteTodoHandler(w http.ResponseWriter, r *http.Request) {
 	if id := getID(w, r); id > 0 {
 		if err := a.db.Delete(r.Context(), id); err == nil {
 			w.WriteHeader(http.StatusNoContent)
 		} else {
-			handleError(w, err)
+			handleError(w, r, err)
+		}
+	}
+}
+
+// @Summary Get the change history of a TODO
+// @Produce json
+// @Param   id path int true "TODO ID"
+// @Success 200 {object} []models.TodoVersion
+// @Failure 404 {object} models.Error "Not found"
+// @Failure 500 {object} models.Error "Backend error"
+// @Router  /api/v1/todos/{id}/history [get]
+func (a *App) getTodoHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if id := getID(w, r); id > 0 {
+		if versions, err := a.db.History(r.Context(), id); err == nil {
+			sendJSON(w, versions)
+		} else {
+			handleError(w, r, err)
+		}
+	}
+}
+
+// @Summary Revert a TODO to a previous version
+// @Produce json
+// @Param   id path int true "TODO ID"
+// @Param   version query int true "Version to restore"
+// @Param   If-Match header string false "Current version of the TODO"
+// @Param   Idempotency-Key header string false "Key to safely retry the request"
+// @Success 200 {object} models.Todo
+// @Failure 400 {object} models.Error "Invalid version"
+// @Failure 404 {object} models.Error "Not found"
+// @Failure 409 {object} models.Error "Modified concurrently"
+// @Failure 412 {object} models.Error "If-Match is weak or does not match the current version"
+// @Failure 500 {object} models.Error "Backend error"
+// @Router  /api/v1/todos/{id}/revert [post]
+func (a *App) revertTodoHandler(w http.ResponseWriter, r *http.Request) {
+	if id := getID(w, r); id > 0 {
+		version, err := strconv.Atoi(r.URL.Query().Get("version"))
+		if err != nil || version < 1 {
+			sendError(w, r, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		expected, err := getIfMatch(r)
+		if errors.Is(err, errWeakIfMatch) {
+			sendError(w, r, err.Error(), http.StatusPreconditionFailed)
+			return
+		} else if err != nil {
+			sendError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if todo, err := a.db.Revert(r.Context(), id, version, expected); err == nil {
+			setETag(w, todo)
+			sendJSON(w, todo)
+		} else if err == database.ErrorConflict && expected > 0 {
+			// The TODO is no longer at the version given in If-Match
+			sendError(w, r, err.Error(), http.StatusPreconditionFailed)
+		} else {
+			handleError(w, r, err)
 		}
 	}
 }
@@ -7,9 +7,13 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strings"
 	"testing"
 	"time"
+	"todo-api/app/config"
 	"todo-api/app/database"
+	"todo-api/app/middleware"
 	"todo-api/app/models"
 
 	"gotest.tools/v3/assert"
@@ -18,8 +22,9 @@ import (
 var ErrorMockInternal = errors.New("something went wrong")
 
 type MockDB struct {
-	todos []*models.Todo
-	fail  bool
+	todos    []*models.Todo
+	versions map[int][]models.TodoVersion
+	fail     bool
 }
 
 func (db *MockDB) Init() error {
@@ -37,23 +42,64 @@ func (db *MockDB) Init() error {
 			},
 		},
 	}
+	db.versions = make(map[int][]models.TodoVersion)
+	for _, todo := range db.todos {
+		db.addVersion(todo)
+	}
 	return nil
 }
 
+func (db *MockDB) addVersion(todo *models.Todo) {
+	todo.Version++
+	db.versions[todo.ID] = append(db.versions[todo.ID], models.NewTodoVersion(*todo))
+}
+
 func (db *MockDB) Shutdown() {
 }
 
-func (db *MockDB) GetAll(ctx context.Context) ([]models.Todo, error) {
+func (db *MockDB) PendingMigrations(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (db *MockDB) Ping(ctx context.Context) error {
 	if db.fail {
-		return nil, ErrorMockInternal
+		return ErrorMockInternal
 	}
-	todos := make([]models.Todo, len(db.todos))
-	for i, todo := range db.todos {
-		todos[i] = *todo
+	return nil
+}
+
+func (db *MockDB) GetAll(ctx context.Context, filter database.Filter) ([]models.Todo, error) {
+	todos := make([]models.Todo, 0)
+	err := db.Each(ctx, filter, func(todo models.Todo) error {
+		todos = append(todos, todo)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return todos, nil
 }
 
+func (db *MockDB) Each(ctx context.Context, filter database.Filter, fn func(models.Todo) error) error {
+	if db.fail {
+		return ErrorMockInternal
+	}
+	for _, todo := range db.todos {
+		switch {
+		case filter.Completed != nil && todo.Completed != *filter.Completed,
+			filter.Priority > 0 && todo.Priority != filter.Priority,
+			filter.DueBefore != nil && (todo.DueAt == nil || !todo.DueAt.Before(*filter.DueBefore)),
+			filter.DueAfter != nil && (todo.DueAt == nil || todo.DueAt.Before(*filter.DueAfter)),
+			!strings.Contains(strings.ToLower(todo.Title), strings.ToLower(filter.Query)):
+			continue
+		}
+		if err := fn(*todo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (db *MockDB) Get(ctx context.Context, id int) (models.Todo, error) {
 	if db.fail {
 		return models.Todo{}, ErrorMockInternal
@@ -73,15 +119,59 @@ func (db *MockDB) Add(ctx context.Context, base models.Base) (models.Todo, error
 	todo.ID = len(db.todos) - 1
 	todo.CreatedAt = time.Now()
 	todo.UpdatedAt = time.Now()
+	db.addVersion(&todo)
 	return todo, nil
 }
 
+func (db *MockDB) AddBatch(ctx context.Context, todos []models.Todo, dedupe []string) ([]models.Todo, []int, error) {
+	dups, err := db.Duplicates(ctx, todos, dedupe)
+	if err != nil {
+		return nil, nil, err
+	}
+	added := make([]models.Todo, 0, len(todos))
+	for i, todo := range todos {
+		if slices.Contains(dups, i) {
+			continue
+		}
+		dbtodo, _ := db.Add(ctx, todo.Base)
+		if todo.Completed {
+			db.todos[dbtodo.ID].SetCompleted(true, time.Now())
+			dbtodo = *db.todos[dbtodo.ID]
+		}
+		added = append(added, dbtodo)
+	}
+	return added, dups, nil
+}
+
+func (db *MockDB) Duplicates(ctx context.Context, todos []models.Todo, dedupe []string) ([]int, error) {
+	if db.fail {
+		return nil, ErrorMockInternal
+	}
+	if len(dedupe) == 0 {
+		return nil, nil
+	}
+	seen := make(map[string]bool)
+	for _, todo := range db.todos {
+		seen[database.DedupeKey(*todo, dedupe)] = true
+	}
+	var dups []int
+	for i, todo := range todos {
+		key := database.DedupeKey(todo, dedupe)
+		if seen[key] {
+			dups = append(dups, i)
+		}
+		seen[key] = true
+	}
+	return dups, nil
+}
+
 func (db *MockDB) SetStatus(ctx context.Context, id int, status models.Status) error {
 	if db.fail {
 		return ErrorMockInternal
 	}
 	if id < len(db.todos) {
-		db.todos[id].Completed = status.Completed
+		db.todos[id].SetCompleted(status.Completed, time.Now())
+		db.addVersion(db.todos[id])
 		return nil
 	}
 	return database.ErrorNotFound
@@ -98,6 +188,60 @@ func (db *MockDB) Delete(ctx context.Context, id int) error {
 	return database.ErrorNotFound
 }
 
+func (db *MockDB) History(ctx context.Context, id int) ([]models.TodoVersion, error) {
+	if db.fail {
+		return nil, ErrorMockInternal
+	}
+	if _, err := db.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	return db.versions[id], nil
+}
+
+func (db *MockDB) Revert(ctx context.Context, id int, version int, expected int) (models.Todo, error) {
+	if db.fail {
+		return models.Todo{}, ErrorMockInternal
+	}
+	if _, err := db.Get(ctx, id); err != nil {
+		return models.Todo{}, err
+	}
+	todo := db.todos[id]
+	if expected > 0 && todo.Version != expected {
+		return models.Todo{}, database.ErrorConflict
+	}
+	for _, v := range db.versions[id] {
+		if v.Version == version {
+			todo.Base = v.Base
+			todo.SetCompleted(v.Completed, time.Now())
+			db.addVersion(todo)
+			return *todo, nil
+		}
+	}
+	return models.Todo{}, database.ErrorNotFound
+}
+
+func (db *MockDB) Stats(ctx context.Context) ([]models.PriorityStats, error) {
+	if db.fail {
+		return nil, ErrorMockInternal
+	}
+	stats := make(map[int]*models.PriorityStats)
+	for _, todo := range db.todos {
+		if _, ok := stats[todo.Priority]; !ok {
+			stats[todo.Priority] = &models.PriorityStats{Priority: todo.Priority}
+		}
+		if todo.Completed {
+			stats[todo.Priority].Completed++
+		} else {
+			stats[todo.Priority].Open++
+		}
+	}
+	result := make([]models.PriorityStats, 0)
+	for _, s := range stats {
+		result = append(result, *s)
+	}
+	return result, nil
+}
+
 func TestAddTodoHandler(t *testing.T) {
 	srv, db := newMockApp(false)
 
@@ -132,6 +276,31 @@ func TestAddTodoHandlerInvalidData(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 }
 
+func TestAddTodoHandlerTooLarge(t *testing.T) {
+	srv, _ := newMockApp(false)
+	cfg := config.Default()
+	cfg.Server.MaxBodyBytes = 16
+	srv.config.Store(cfg)
+	srv.router = http.NewServeMux()
+	srv.initRoutes()
+	body := `{"title":"This title does not fit"}`
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// Bodies of unknown length fail while being read
+	for _, key := range []string{"", "key"} {
+		r = httptest.NewRequest(http.MethodPost, "/api/v1/todos", strings.NewReader(body))
+		r.ContentLength = -1
+		r.Header.Set(middleware.IdempotencyKeyHeader, key)
+		w = httptest.NewRecorder()
+		srv.router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
 func TestAddTodoHandlerServerError(t *testing.T) {
 	srv, _ := newMockApp(true)
 
@@ -177,6 +346,147 @@ func TestGetTodosHandlerServerError(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 }
 
+func TestGetTodosHandlerFiltered(t *testing.T) {
+	srv, db := newMockApp(false)
+	db.todos[1].Completed = true
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/todos?completed=true&q=db", nil)
+	w := httptest.NewRecorder()
+	srv.getTodosHandler(w, r)
+	todos := make([]models.Todo, 0)
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&todos))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, len(todos))
+	assert.Equal(t, "Test DB", todos[0].Title)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/todos?priority=high", nil)
+	w = httptest.NewRecorder()
+	srv.getTodosHandler(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestExportTodosHandler(t *testing.T) {
+	srv, db := newMockApp(false)
+	db.todos[1].Completed = true
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/todos/export?completed=false", nil)
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	filename := "todos-" + time.Now().Format(time.DateOnly) + ".csv"
+	assert.Equal(t, `attachment; filename=`+filename, w.Header().Get("Content-Disposition"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Assert(t, strings.HasPrefix(lines[1], "0,Test API,"))
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/todos/export?format=ndjson", nil)
+	w = httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	assert.Equal(t, 2, strings.Count(w.Body.String(), "\n"))
+
+	for _, query := range []string{"format=xlsx", "due_before=soon"} {
+		r = httptest.NewRequest(http.MethodGet, "/api/v1/todos/export?"+query, nil)
+		w = httptest.NewRecorder()
+		srv.router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestExportTodosHandlerServerError(t *testing.T) {
+	srv, _ := newMockApp(true)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/todos/export?format=markdown", nil)
+	w := httptest.NewRecorder()
+	srv.exportTodosHandler(w, r)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Disposition"))
+}
+
+func TestImportTodosHandler(t *testing.T) {
+	srv, db := newMockApp(false)
+	body := "title,priority,completed\nTest API,1,\nWrite docs,2,true\nwrite DOCS,2,\n"
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos/import?format=csv&dedupe=title&dry_run=true", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	result := models.ImportResult{}
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, true, result.DryRun)
+	assert.Equal(t, 1, result.Imported)
+	assert.Equal(t, 2, result.Skipped)
+	assert.Equal(t, 2, len(db.todos))
+
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/todos/import?format=csv&dedupe=title", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, 3, len(db.todos))
+	assert.Equal(t, "Write docs", db.todos[2].Title)
+	assert.Equal(t, true, db.todos[2].Completed)
+}
+
+func TestImportTodosHandlerInvalidRows(t *testing.T) {
+	srv, db := newMockApp(false)
+	body := "Call mom\nPay the rent due:tomorrow\n"
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos/import?format=todotxt", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	result := models.ImportResult{}
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, 1, result.Failed)
+	assert.DeepEqual(t, []models.ImportRow{
+		{Line: 2, Title: "Pay the rent", Status: "invalid", Reason: "due: must be a date like 2024-05-31"},
+	}, result.Rows)
+	// Nothing is imported when a row is invalid
+	assert.Equal(t, 2, len(db.todos))
+
+	for _, query := range []string{"", "format=xlsx", "format=csv&dry_run=maybe", "format=csv&dedupe=uuid"} {
+		r = httptest.NewRequest(http.MethodPost, "/api/v1/todos/import?"+query, strings.NewReader(body))
+		w = httptest.NewRecorder()
+		srv.router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestImportTodosHandlerTooLarge(t *testing.T) {
+	srv, _ := newMockApp(false)
+	cfg := config.Default()
+	cfg.Server.MaxBodyBytes = 16
+	cfg.Server.MaxImportBytes = 64
+	srv.config.Store(cfg)
+	srv.router = http.NewServeMux()
+	srv.initRoutes()
+
+	// Imports have their own limit
+	body := "Call mom\nPay the rent\n"
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos/import?format=todotxt", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	body = strings.Repeat(body, 4)
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/todos/import?format=todotxt", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	srv.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestImportTodosHandlerServerError(t *testing.T) {
+	srv, _ := newMockApp(true)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos/import?format=ndjson", strings.NewReader(`{"title": "Call mom"}`))
+	w := httptest.NewRecorder()
+	srv.importTodosHandler(w, r)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
 func TestGetTodoHandler(t *testing.T) {
 	srv, _ := newMockApp(false)
 
@@ -333,3 +643,163 @@ func TestDeleteTodosHandlerServerError(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 	assert.Equal(t, 2, len(db.todos))
 }
+
+func TestGetTodoHistoryHandler(t *testing.T) {
+	srv, db := newMockApp(false)
+	db.SetStatus(context.Background(), 1, models.Status{Completed: true})
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/todos/1/history", nil)
+	w := httptest.NewRecorder()
+	r.SetPathValue("id", "1")
+
+	srv.getTodoHistoryHandler(w, r)
+
+	resp := w.Result()
+	versions := make([]models.TodoVersion, 0)
+	err := json.NewDecoder(resp.Body).Decode(&versions)
+	assert.NilError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, len(versions))
+	assert.Equal(t, 2, versions[1].Version)
+	assert.Assert(t, versions[1].Completed)
+}
+
+func TestGetTodoHistoryHandlerNotFound(t *testing.T) {
+	srv, _ := newMockApp(false)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/todos/10/history", nil)
+	w := httptest.NewRecorder()
+	r.SetPathValue("id", "10")
+
+	srv.getTodoHistoryHandler(w, r)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRevertTodoHandler(t *testing.T) {
+	srv, db := newMockApp(false)
+	db.SetStatus(context.Background(), 1, models.Status{Completed: true})
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos/1/revert?version=1", nil)
+	r.Header.Set("If-Match", `"2"`)
+	w := httptest.NewRecorder()
+	r.SetPathValue("id", "1")
+
+	srv.revertTodoHandler(w, r)
+
+	resp := w.Result()
+	todo := new(models.Todo)
+	err := json.NewDecoder(resp.Body).Decode(todo)
+	assert.NilError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"3"`, resp.Header.Get("ETag"))
+	assert.Equal(t, 3, todo.Version)
+	assert.Assert(t, db.todos[1].Completed == false)
+}
+
+func TestRevertTodoHandlerPreconditionFailed(t *testing.T) {
+	srv, db := newMockApp(false)
+	db.SetStatus(context.Background(), 1, models.Status{Completed: true})
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos/1/revert?version=1", nil)
+	r.Header.Set("If-Match", `"1"`)
+	w := httptest.NewRecorder()
+	r.SetPathValue("id", "1")
+
+	srv.revertTodoHandler(w, r)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	assert.Assert(t, db.todos[1].Completed)
+}
+
+// ConflictDB simulates a TODO modified while it is being reverted.
+type ConflictDB struct {
+	MockDB
+}
+
+func (db *ConflictDB) Revert(ctx context.Context, id int, version int, expected int) (models.Todo, error) {
+	return models.Todo{}, database.ErrorConflict
+}
+
+func TestRevertTodoHandlerConcurrentUpdate(t *testing.T) {
+	srv, _ := newMockApp(false)
+	srv.db = &ConflictDB{}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos/1/revert?version=1", nil)
+	w := httptest.NewRecorder()
+	r.SetPathValue("id", "1")
+
+	srv.revertTodoHandler(w, r)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestRevertTodoHandlerWeakETag(t *testing.T) {
+	srv, db := newMockApp(false)
+	db.SetStatus(context.Background(), 1, models.Status{Completed: true})
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos/1/revert?version=1", nil)
+	r.Header.Set("If-Match", `W/"2"`)
+	w := httptest.NewRecorder()
+	r.SetPathValue("id", "1")
+
+	srv.revertTodoHandler(w, r)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	assert.Assert(t, db.todos[1].Completed)
+}
+
+func TestRevertTodoHandlerInvalidVersion(t *testing.T) {
+	srv, _ := newMockApp(false)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos/1/revert?version=x", nil)
+	w := httptest.NewRecorder()
+	r.SetPathValue("id", "1")
+
+	srv.revertTodoHandler(w, r)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestRevertTodoHandlerVersionNotFound(t *testing.T) {
+	srv, _ := newMockApp(false)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos/1/revert?version=5", nil)
+	w := httptest.NewRecorder()
+	r.SetPathValue("id", "1")
+
+	srv.revertTodoHandler(w, r)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAddTodoHandlerIdempotent(t *testing.T) {
+	srv, db := newMockApp(false)
+
+	var first models.Todo
+	for i := range 3 {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/todos", bytes.NewBufferString(`{"title":"Retry"}`))
+		r.Header.Set("Idempotency-Key", "2c5f1a2e")
+		w := httptest.NewRecorder()
+		srv.router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		todo := models.Todo{}
+		assert.NilError(t, json.NewDecoder(w.Body).Decode(&todo))
+		if i == 0 {
+			first = todo
+			assert.Equal(t, "", w.Header().Get("Idempotent-Replayed"))
+			continue
+		}
+		assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+		assert.DeepEqual(t, first, todo)
+	}
+	assert.Equal(t, 2, first.ID)
+	assert.Equal(t, 3, len(db.todos))
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+	"todo-api/app/models"
+	"todo-api/app/version"
+)
+
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+var startTime = time.Now()
+
+var errDatabaseUnreachable = errors.New("unreachable")
+
+func newCheck(start time.Time, err error) models.Check {
+	check := models.Check{Status: StatusUp}
+	if !start.IsZero() {
+		check.Latency = time.Since(start).String()
+	}
+	if err != nil {
+		check.Status = StatusDown
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// checkHealth verifies every dependency required to serve traffic.
+func (a *App) checkHealth(ctx context.Context) models.Health {
+	health := models.Health{
+		Status:  StatusUp,
+		Version: version.Version,
+		Uptime:  time.Since(startTime).Round(time.Second).String(),
+		Checks:  make(map[string]models.Check),
+	}
+
+	var err error
+	if a.shuttingDown.Load() {
+		err = errors.New("shutting down")
+	}
+	health.Checks["server"] = newCheck(time.Time{}, err)
+
+	// The connection is only safe to use once connectDB has published it
+	if a.dbReady.Load() {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		start := time.Now()
+		if err = a.db.Ping(ctx); err != nil {
+			// Driver errors can reveal hosts and users to the public endpoints
+			slog.WarnContext(ctx, "database health check failed", slog.String("error", err.Error()))
+			err = errDatabaseUnreachable
+		}
+		health.Checks["database"] = newCheck(start, err)
+	} else {
+		health.Checks["database"] = newCheck(time.Time{}, errDatabaseUnreachable)
+	}
+
+	err = nil
+	if !a.dbMigrated.Load() {
+		err = errors.New("schema not initialized")
+	}
+	health.Checks["migrations"] = newCheck(time.Time{}, err)
+
+	for _, check := range health.Checks {
+		if check.Status != StatusUp {
+			health.Status = StatusDown
+		}
+	}
+	return health
+}
+
+// @Summary Liveness probe
+// @Produce plain
+// @Success 200 "The process is alive"
+// @Router  /healthz [get]
+func (a *App) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// @Summary Readiness probe
+// @Produce plain
+// @Success 200 "Ready to serve traffic"
+// @Failure 503 "Not ready"
+// @Router  /readyz [get]
+func (a *App) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	health := a.checkHealth(r.Context())
+	if health.Status != StatusUp {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for name, check := range health.Checks {
+			if check.Status != StatusUp {
+				w.Write([]byte(name + ": " + check.Error + "\n"))
+			}
+		}
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// @Summary Detailed health report
+// @Produce json
+// @Success 200 {object} models.Health
+// @Failure 503 {object} models.Health
+// @Router  /health [get]
+func (a *App) healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	health := a.checkHealth(r.Context())
+	if health.Status != StatusUp {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	sendJSON(w, health)
+}
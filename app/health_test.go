@@ -0,0 +1,123 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"todo-api/app/database"
+	"todo-api/app/models"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLivenessHandler(t *testing.T) {
+	srv, _ := newMockApp(true)
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestReadinessHandler(t *testing.T) {
+	srv, _ := newMockApp(false)
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	srv.shuttingDown.Store(true)
+	w = httptest.NewRecorder()
+	srv.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "server: shutting down\n", w.Body.String())
+}
+
+func TestReadinessHandlerNotMigrated(t *testing.T) {
+	srv, _ := newMockApp(false)
+	srv.dbMigrated.Store(false)
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestHealthHandler(t *testing.T) {
+	srv, _ := newMockApp(false)
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	health := models.Health{}
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&health))
+	assert.Equal(t, StatusUp, health.Status)
+	assert.Equal(t, StatusUp, health.Checks["database"].Status)
+	assert.Assert(t, health.Checks["database"].Latency != "")
+}
+
+func TestHealthHandlerDatabaseDown(t *testing.T) {
+	srv, _ := newMockApp(true)
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	health := models.Health{}
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&health))
+	assert.Equal(t, StatusDown, health.Status)
+	assert.Equal(t, "unreachable", health.Checks["database"].Error)
+	assert.Equal(t, StatusUp, health.Checks["server"].Status)
+}
+
+// ConnectingDB publishes its connection without synchronization, like
+// database.DB, so that the race detector reports pings during Init.
+type ConnectingDB struct {
+	FlakyDB
+	connected bool
+}
+
+func (db *ConnectingDB) Init() error {
+	if err := db.FlakyDB.Init(); err != nil {
+		return err
+	}
+	// The connection is set before the pool is configured
+	db.connected = true
+	time.Sleep(10 * time.Millisecond)
+	return nil
+}
+
+func (db *ConnectingDB) Ping(ctx context.Context) error {
+	if !db.connected {
+		return database.ErrorNotConnected
+	}
+	return nil
+}
+
+func TestHealthHandlerWhileConnecting(t *testing.T) {
+	srv, _ := newMockApp(false)
+	db := &ConnectingDB{}
+	db.failures.Store(20)
+	srv.db = db
+	srv.dbReady.Store(false)
+	srv.obs = newTestObserver()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.connectDB(context.Background())
+	}()
+
+	for connecting := true; connecting; {
+		select {
+		case <-done:
+			connecting = false
+		default:
+		}
+		w := httptest.NewRecorder()
+		srv.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		health := models.Health{}
+		assert.NilError(t, json.NewDecoder(w.Body).Decode(&health))
+		if health.Checks["database"].Status == StatusDown {
+			assert.Equal(t, "unreachable", health.Checks["database"].Error)
+		}
+	}
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,389 @@
+// Package importer reads TODOs exported by this service or by other tools,
+// reporting the rows that cannot be imported instead of stopping at them.
+package importer
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"todo-api/app/database"
+	"todo-api/app/export"
+	"todo-api/app/models"
+)
+
+const (
+	JSON        = "json"
+	NDJSON      = "ndjson"
+	CSV         = "csv"
+	TodoTxt     = "todotxt"
+	Taskwarrior = "taskwarrior"
+)
+
+// Formats lists the supported formats.
+var Formats = []string{JSON, NDJSON, CSV, TodoTxt, Taskwarrior}
+
+// Row is a TODO read from the input. Line is its line, or its position in
+// the array for the JSON formats. Rows with an error are invalid, and rows
+// with a skip reason are valid but not imported.
+type Row struct {
+	Line int
+	Todo models.Todo
+	Err  error
+	Skip string
+}
+
+// Parse reads the rows of the input in the format. The error is only set
+// when the input cannot be read at all, like malformed CSV or JSON.
+func Parse(r io.Reader, format string) ([]Row, error) {
+	var rows []Row
+	var err error
+	switch format {
+	case JSON:
+		rows, err = parseJSON(r, func(dec *json.Decoder) (Row, error) {
+			row := Row{}
+			return row, dec.Decode(&row.Todo)
+		})
+	case Taskwarrior:
+		rows, err = parseJSON(r, decodeTask)
+	case NDJSON:
+		rows, err = parseLines(r, func(line string) (models.Todo, error) {
+			todo := models.Todo{}
+			return todo, json.Unmarshal([]byte(line), &todo)
+		})
+	case CSV:
+		rows, err = parseCSV(r)
+	case TodoTxt:
+		rows, err = parseLines(r, parseTodoTxt)
+	default:
+		return nil, fmt.Errorf("unsupported format %q, must be one of %s", format, strings.Join(Formats, ", "))
+	}
+	for i := range rows {
+		if rows[i].Err == nil {
+			rows[i].Err = validate(rows[i].Todo)
+		}
+	}
+	return rows, err
+}
+
+func validate(todo models.Todo) error {
+	if strings.TrimSpace(todo.Title) == "" {
+		return errors.New("missing title")
+	}
+	if todo.Priority < 0 {
+		return errors.New("priority: must be positive")
+	}
+	return nil
+}
+
+// parseJSON reads an array of objects, or a sequence of them as written by
+// older versions of Taskwarrior.
+func parseJSON(r io.Reader, decode func(*json.Decoder) (Row, error)) ([]Row, error) {
+	dec := json.NewDecoder(r)
+	array := peek(dec) == '['
+	if array {
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	var rows []Row
+	for dec.More() {
+		row, err := decode(dec)
+		if err != nil {
+			// Values of the wrong type are skipped, unlike malformed JSON
+			var typeErr *json.UnmarshalTypeError
+			if !errors.As(err, &typeErr) {
+				return nil, err
+			}
+			row.Err = err
+		}
+		row.Line = len(rows) + 1
+		rows = append(rows, row)
+	}
+	if array {
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// peek returns the first byte of the next JSON value, or zero at the end of
+// the input.
+func peek(dec *json.Decoder) byte {
+	// More skips the whitespace before the value
+	if !dec.More() {
+		return 0
+	}
+	b := []byte{0}
+	dec.Buffered().Read(b)
+	return b[0]
+}
+
+// parseLines reads one TODO per line, ignoring blank lines.
+func parseLines(r io.Reader, parse func(line string) (models.Todo, error)) ([]Row, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	var rows []Row
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		todo, err := parse(text)
+		rows = append(rows, Row{Line: line, Todo: todo, Err: err})
+	}
+	return rows, scanner.Err()
+}
+
+// parseCSV reads a header naming the columns, like the CSV export. Only
+// title is required, and the columns of other fields are ignored.
+func parseCSV(r io.Reader) ([]Row, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		if i == 0 {
+			// Spreadsheets may start the file with a byte order mark
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["title"]; !ok {
+		return nil, errors.New("missing title column")
+	}
+
+	var rows []Row
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := Row{Line: line}
+		// Exports escape the cells that spreadsheets take for formulas
+		row.Todo.Title = export.UnescapeFormula(field("title"))
+		row.Todo.Description = export.UnescapeFormula(field("description"))
+		if value := field("priority"); value != "" {
+			if row.Todo.Priority, err = strconv.Atoi(value); err != nil {
+				row.Err = errors.New("priority: must be an integer")
+			}
+		}
+		if value := field("completed"); value != "" {
+			if row.Todo.Completed, err = strconv.ParseBool(value); err != nil {
+				row.Err = errors.New("completed: must be true or false")
+			}
+		}
+		if value := field("due_at"); value != "" {
+			if row.Todo.DueAt, err = parseTime(value); err != nil {
+				row.Err = errors.New("due_at: must be an RFC 3339 time or a date")
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+func parseTime(value string) (*time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// parseTodoTxt reads a line of the todo.txt format, like
+// "x 2024-05-02 2024-05-01 (A) Call mom +family due:2024-05-03". Projects
+// and contexts stay in the title, while the due and pri tags are removed.
+func parseTodoTxt(line string) (models.Todo, error) {
+	todo := models.Todo{}
+	words := strings.Fields(line)
+	if len(words) > 0 && words[0] == "x" {
+		todo.Completed = true
+		words = words[1:]
+	}
+	if len(words) > 0 && isPriority(words[0]) {
+		todo.Priority = int(words[0][1]-'A') + 1
+		words = words[1:]
+	}
+	// Completion and creation dates, which cannot be imported
+	for range 2 {
+		if len(words) > 0 && isDate(words[0]) {
+			words = words[1:]
+		}
+	}
+
+	var title []string
+	var err error
+	for _, word := range words {
+		key, value, _ := strings.Cut(word, ":")
+		switch {
+		case key == "due" && value != "":
+			if due, parseErr := time.Parse(time.DateOnly, value); parseErr == nil {
+				todo.DueAt = &due
+			} else {
+				err = errors.New("due: must be a date like 2024-05-31")
+			}
+		case key == "pri" && len(value) == 1 && value[0] >= 'A' && value[0] <= 'Z':
+			todo.Priority = int(value[0]-'A') + 1
+		default:
+			title = append(title, word)
+		}
+	}
+	todo.Title = strings.Join(title, " ")
+	return todo, err
+}
+
+func isPriority(word string) bool {
+	return len(word) == 3 && word[0] == '(' && word[1] >= 'A' && word[1] <= 'Z' && word[2] == ')'
+}
+
+func isDate(word string) bool {
+	_, err := time.Parse(time.DateOnly, word)
+	return err == nil
+}
+
+// task is an entry of the "task export" command of Taskwarrior.
+type task struct {
+	Description string `json:"description"`
+	Status      string `json:"status"`
+	Priority    string `json:"priority"`
+	Due         string `json:"due"`
+	Annotations []struct {
+		Description string `json:"description"`
+	} `json:"annotations"`
+}
+
+var taskPriorities = map[string]int{"H": 1, "M": 2, "L": 3}
+
+// decodeTask skips deleted tasks and the templates of recurring ones, whose
+// occurrences are exported as separate tasks.
+func decodeTask(dec *json.Decoder) (Row, error) {
+	t := task{}
+	if err := dec.Decode(&t); err != nil {
+		return Row{}, err
+	}
+	row := Row{Todo: models.Todo{
+		Base:      models.Base{Title: t.Description},
+		Completed: t.Status == "completed",
+	}}
+	switch t.Status {
+	case "deleted":
+		row.Skip = "deleted"
+	case "recurring":
+		row.Skip = "recurring template"
+	}
+	notes := make([]string, len(t.Annotations))
+	for i, annotation := range t.Annotations {
+		notes[i] = annotation.Description
+	}
+	row.Todo.Description = strings.Join(notes, "\n")
+	if t.Priority != "" {
+		priority, ok := taskPriorities[t.Priority]
+		if !ok {
+			row.Err = fmt.Errorf("priority: unknown value %q, must be H, M or L", t.Priority)
+		}
+		row.Todo.Priority = priority
+	}
+	if t.Due != "" {
+		due, err := time.Parse("20060102T150405Z", t.Due)
+		if err != nil {
+			row.Err = fmt.Errorf("due: invalid date %q", t.Due)
+		} else {
+			row.Todo.DueAt = &due
+		}
+	}
+	return row, nil
+}
+
+// ParseDedupe reads a comma-separated list of fields identifying duplicates.
+func ParseDedupe(value string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if !slices.Contains(database.DedupeFields, field) {
+			return nil, fmt.Errorf("dedupe: unknown field %q, must be one of %s", field, strings.Join(database.DedupeFields, ", "))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Import adds the valid rows in a single transaction, skipping those whose
+// fields match a TODO of the database or an earlier row. Nothing is added
+// when a row is invalid or on a dry run, but duplicates are still reported.
+func Import(ctx context.Context, db database.TodoDB, rows []Row, fields []string, dryRun bool) error {
+	var todos []models.Todo
+	var index []int
+	failed := false
+	for i, row := range rows {
+		switch {
+		case row.Err != nil:
+			failed = true
+		case row.Skip == "":
+			todos = append(todos, row.Todo)
+			index = append(index, i)
+		}
+	}
+	var dups []int
+	var err error
+	if failed || dryRun {
+		dups, err = db.Duplicates(ctx, todos, fields)
+	} else {
+		_, dups, err = db.AddBatch(ctx, todos, fields)
+	}
+	if err != nil {
+		return err
+	}
+	for _, i := range dups {
+		rows[index[i]].Skip = "duplicate"
+	}
+	return nil
+}
+
+// Summarize counts the rows by outcome and lists the ones not imported.
+func Summarize(rows []Row) models.ImportResult {
+	result := models.ImportResult{Total: len(rows), Rows: []models.ImportRow{}}
+	for _, row := range rows {
+		switch {
+		case row.Err != nil:
+			result.Failed++
+			result.Rows = append(result.Rows, models.ImportRow{
+				Line: row.Line, Title: row.Todo.Title, Status: "invalid", Reason: row.Err.Error(),
+			})
+		case row.Skip != "":
+			result.Skipped++
+			result.Rows = append(result.Rows, models.ImportRow{
+				Line: row.Line, Title: row.Todo.Title, Status: "skipped", Reason: row.Skip,
+			})
+		default:
+			result.Imported++
+		}
+	}
+	return result
+}
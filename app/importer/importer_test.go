@@ -0,0 +1,235 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"todo-api/app/database"
+	"todo-api/app/export"
+	"todo-api/app/models"
+
+	"gotest.tools/v3/assert"
+)
+
+func parse(t *testing.T, format, input string) []Row {
+	t.Helper()
+	rows, err := Parse(strings.NewReader(input), format)
+	assert.NilError(t, err)
+	return rows
+}
+
+func TestParseCSV(t *testing.T) {
+	rows := parse(t, CSV, "\ufeffTitle,Priority,Completed,Due_At,Notes\n"+
+		"Buy milk,2,true,2024-06-01,ignored\n"+
+		",1,,,\n"+
+		"\"Write\nreport\",high,,,\n"+
+		"Call mom,,,2024-06-01T10:00:00+02:00\n")
+	assert.Equal(t, 4, len(rows))
+
+	assert.NilError(t, rows[0].Err)
+	assert.Equal(t, 2, rows[0].Line)
+	assert.Equal(t, "Buy milk", rows[0].Todo.Title)
+	assert.Equal(t, 2, rows[0].Todo.Priority)
+	assert.Equal(t, true, rows[0].Todo.Completed)
+	assert.Equal(t, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), *rows[0].Todo.DueAt)
+
+	assert.ErrorContains(t, rows[1].Err, "missing title")
+	assert.Equal(t, 4, rows[2].Line)
+	assert.ErrorContains(t, rows[2].Err, "priority: must be an integer")
+	assert.NilError(t, rows[3].Err)
+	assert.Equal(t, 6, rows[3].Line)
+	assert.Equal(t, time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC), rows[3].Todo.DueAt.UTC())
+
+	_, err := Parse(strings.NewReader("name,priority\nBuy milk,2\n"), CSV)
+	assert.ErrorContains(t, err, "missing title column")
+}
+
+func TestParseExported(t *testing.T) {
+	due := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	todos := []models.Todo{
+		{ID: 7, Base: models.Base{Title: "Buy milk, eggs", Description: "Two\nlines", Priority: 2, DueAt: &due}},
+		{ID: 8, Base: models.Base{Title: "Call mom", Priority: 1}, Completed: true},
+		{ID: 9, Base: models.Base{Title: "=1+1", Description: "-2", Priority: 1}},
+	}
+	for _, format := range []string{JSON, NDJSON, CSV} {
+		var buf bytes.Buffer
+		w, err := export.NewWriter(&buf, format)
+		assert.NilError(t, err)
+		for _, todo := range todos {
+			assert.NilError(t, w.Write(todo))
+		}
+		assert.NilError(t, w.Close())
+
+		rows := parse(t, format, buf.String())
+		assert.Equal(t, 3, len(rows), format)
+		for i, row := range rows {
+			assert.NilError(t, row.Err, format)
+			assert.DeepEqual(t, todos[i].Base, row.Todo.Base)
+			assert.Equal(t, todos[i].Completed, row.Todo.Completed)
+		}
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	rows := parse(t, JSON, `[{"title": "Buy milk"}, {"title": 42}, {"priority": 2}]`)
+	assert.Equal(t, 3, len(rows))
+	assert.NilError(t, rows[0].Err)
+	assert.ErrorContains(t, rows[1].Err, "cannot unmarshal number")
+	assert.Equal(t, 3, rows[2].Line)
+	assert.ErrorContains(t, rows[2].Err, "missing title")
+
+	assert.Equal(t, 0, len(parse(t, JSON, "  ")))
+	_, err := Parse(strings.NewReader(`[{"title": "Buy milk"}`), JSON)
+	assert.Assert(t, err != nil)
+}
+
+func TestParseNDJSON(t *testing.T) {
+	rows := parse(t, NDJSON, "{\"title\": \"Buy milk\"}\n\n{\"title\": \n")
+	assert.Equal(t, 2, len(rows))
+	assert.NilError(t, rows[0].Err)
+	assert.Equal(t, 3, rows[1].Line)
+	assert.Assert(t, rows[1].Err != nil)
+}
+
+func TestParseTodoTxt(t *testing.T) {
+	rows := parse(t, TodoTxt, "(A) 2024-05-01 Call mom +family @phone due:2024-05-03\n"+
+		"x 2024-05-02 2024-05-01 Pay the rent pri:B\n"+
+		"\n"+
+		"Renew passport due:soon\n"+
+		"x 2024-05-02\n")
+	assert.Equal(t, 4, len(rows))
+
+	assert.NilError(t, rows[0].Err)
+	assert.Equal(t, "Call mom +family @phone", rows[0].Todo.Title)
+	assert.Equal(t, 1, rows[0].Todo.Priority)
+	assert.Equal(t, false, rows[0].Todo.Completed)
+	assert.Equal(t, time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC), *rows[0].Todo.DueAt)
+
+	assert.NilError(t, rows[1].Err)
+	assert.Equal(t, "Pay the rent", rows[1].Todo.Title)
+	assert.Equal(t, 2, rows[1].Todo.Priority)
+	assert.Equal(t, true, rows[1].Todo.Completed)
+
+	assert.Equal(t, 4, rows[2].Line)
+	assert.ErrorContains(t, rows[2].Err, "due: must be a date")
+	assert.ErrorContains(t, rows[3].Err, "missing title")
+}
+
+func TestParseTaskwarrior(t *testing.T) {
+	input := `[
+{"id":1,"description":"Buy milk","status":"pending","priority":"H","due":"20240601T120000Z",
+ "annotations":[{"entry":"20240501T080000Z","description":"Oat milk"}],"uuid":"a"},
+{"id":0,"description":"Pay the rent","status":"completed","uuid":"b"},
+{"id":0,"description":"Old task","status":"deleted","uuid":"c"},
+{"id":2,"description":"Water plants","status":"pending","priority":"X","uuid":"d"}
+]`
+	rows := parse(t, Taskwarrior, input)
+	assert.Equal(t, 4, len(rows))
+
+	assert.NilError(t, rows[0].Err)
+	assert.Equal(t, "Buy milk", rows[0].Todo.Title)
+	assert.Equal(t, "Oat milk", rows[0].Todo.Description)
+	assert.Equal(t, 1, rows[0].Todo.Priority)
+	assert.Equal(t, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), *rows[0].Todo.DueAt)
+	assert.Equal(t, true, rows[1].Todo.Completed)
+	assert.Equal(t, "deleted", rows[2].Skip)
+	assert.ErrorContains(t, rows[3].Err, `unknown value "X"`)
+
+	// Older versions write one task per line instead of an array
+	rows = parse(t, Taskwarrior, `{"description":"Buy milk","status":"pending"}
+{"description":"Pay the rent","status":"completed"}`)
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, 2, rows[1].Line)
+}
+
+func TestParseUnsupported(t *testing.T) {
+	_, err := Parse(strings.NewReader(""), "xlsx")
+	assert.ErrorContains(t, err, `unsupported format "xlsx"`)
+}
+
+func TestParseDedupe(t *testing.T) {
+	fields, err := ParseDedupe(" title, due_at ")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"title", "due_at"}, fields)
+
+	fields, err = ParseDedupe("")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(fields))
+
+	_, err = ParseDedupe("title,uuid")
+	assert.ErrorContains(t, err, `unknown field "uuid"`)
+}
+
+type existingDB struct {
+	database.TodoDB
+	todos []models.Todo
+	added []models.Todo
+}
+
+func (db *existingDB) Duplicates(ctx context.Context, todos []models.Todo, dedupe []string) ([]int, error) {
+	seen := make(map[string]bool)
+	for _, todo := range db.todos {
+		seen[database.DedupeKey(todo, dedupe)] = true
+	}
+	var dups []int
+	for i, todo := range todos {
+		key := database.DedupeKey(todo, dedupe)
+		if seen[key] {
+			dups = append(dups, i)
+		}
+		seen[key] = true
+	}
+	return dups, nil
+}
+
+func (db *existingDB) AddBatch(ctx context.Context, todos []models.Todo, dedupe []string) ([]models.Todo, []int, error) {
+	dups, _ := db.Duplicates(ctx, todos, dedupe)
+	for i, todo := range todos {
+		if !slices.Contains(dups, i) {
+			db.added = append(db.added, todo)
+		}
+	}
+	return db.added, dups, nil
+}
+
+func TestImport(t *testing.T) {
+	db := &existingDB{todos: []models.Todo{{Base: models.Base{Title: "Buy milk", Priority: 1}}}}
+	rows := parse(t, TodoTxt, "buy milk\nCall mom\n(B) Call mom\nCall mom\n")
+
+	assert.NilError(t, Import(context.Background(), db, rows, []string{"title", "priority"}, false))
+	assert.Equal(t, "duplicate", rows[0].Skip)
+	assert.Equal(t, "", rows[1].Skip)
+	assert.Equal(t, "", rows[2].Skip)
+	assert.Equal(t, "duplicate", rows[3].Skip)
+	assert.Equal(t, 2, len(db.added))
+	assert.Equal(t, 2, db.added[1].Priority)
+
+	result := Summarize(rows)
+	assert.DeepEqual(t, models.ImportResult{
+		Total:    4,
+		Imported: 2,
+		Skipped:  2,
+		Rows: []models.ImportRow{
+			{Line: 1, Title: "buy milk", Status: "skipped", Reason: "duplicate"},
+			{Line: 4, Title: "Call mom", Status: "skipped", Reason: "duplicate"},
+		},
+	}, result)
+}
+
+func TestImportInvalid(t *testing.T) {
+	db := &existingDB{todos: []models.Todo{{Base: models.Base{Title: "Buy milk"}}}}
+	rows := parse(t, TodoTxt, "buy milk\nCall mom\n(A)\n")
+
+	// Duplicates are reported, but nothing is added
+	assert.NilError(t, Import(context.Background(), db, rows, []string{"title"}, false))
+	assert.Equal(t, "duplicate", rows[0].Skip)
+	assert.Equal(t, 0, len(db.added))
+
+	result := Summarize(rows)
+	assert.Equal(t, 1, result.Imported)
+	assert.Equal(t, 1, result.Skipped)
+	assert.Equal(t, 1, result.Failed)
+}
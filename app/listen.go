@@ -0,0 +1,126 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	unixPrefix    = "unix:"
+	systemdPrefix = "systemd"
+	// systemdFirstFD is the first file descriptor passed by systemd
+	systemdFirstFD = 3
+)
+
+// listen opens the listener for addr, which is either a TCP address like
+// ":8080", a Unix socket like "unix:/run/todo/api.sock" created with the
+// given permissions, or "systemd" (the first socket) or "systemd:<name>" (by
+// its FileDescriptorName) for sockets passed through socket activation.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, unixPrefix):
+		return listenUnix(strings.TrimPrefix(addr, unixPrefix), mode)
+	case addr == systemdPrefix || strings.HasPrefix(addr, systemdPrefix+":"):
+		name := strings.TrimPrefix(strings.TrimPrefix(addr, systemdPrefix), ":")
+		listeners, err := inheritedListeners()
+		if err != nil {
+			return nil, err
+		}
+		return listeners.take(name)
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	// Remove the socket left behind by a previous process that crashed
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+type activatedListener struct {
+	name     string
+	listener net.Listener
+}
+
+type activatedListeners struct {
+	mu        sync.Mutex
+	listeners []*activatedListener
+}
+
+// take returns the first unused listener with the given name, or the first
+// unused one when name is empty.
+func (l *activatedListeners) take(name string) (net.Listener, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, a := range l.listeners {
+		if a.listener != nil && (name == "" || a.name == name) {
+			ln := a.listener
+			a.listener = nil
+			return ln, nil
+		}
+	}
+	if name == "" {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+}
+
+// inheritedListeners reads the sockets passed by systemd only once, as the
+// variables describing them are removed so child processes don't see them.
+var inheritedListeners = sync.OnceValues(func() (*activatedListeners, error) {
+	listeners, err := systemdListeners(os.Getenv, systemdFirstFD)
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(name)
+	}
+	return listeners, err
+})
+
+// systemdListeners creates listeners for the file descriptors described by
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES, as done by sd_listen_fds(3).
+func systemdListeners(getenv func(string) string, firstFD int) (*activatedListeners, error) {
+	result := &activatedListeners{}
+	if pid, err := strconv.Atoi(getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return result, nil
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	for i := range count {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(firstFD+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d passed by systemd: %w", firstFD+i, err)
+		}
+		result.listeners = append(result.listeners, &activatedListener{name: name, listener: ln})
+	}
+	return result, nil
+}
@@ -0,0 +1,112 @@
+//go:build unix
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+	ln, err := listen(unixPrefix+path, 0o600)
+	assert.NilError(t, err)
+
+	info, err := os.Stat(path)
+	assert.NilError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	_, err = listen(unixPrefix+path, 0o600)
+	assert.ErrorContains(t, err, "is in use")
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/")
+	assert.NilError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ok", string(body))
+}
+
+func TestListenUnixStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	assert.NilError(t, err)
+	// Leave the socket file behind as a crashed process would
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen(unixPrefix+path, 0)
+	assert.NilError(t, err)
+	ln.Close()
+}
+
+func TestSystemdListeners(t *testing.T) {
+	tcp, err := net.Listen("tcp", "localhost:0")
+	assert.NilError(t, err)
+	defer tcp.Close()
+	f, err := tcp.(*net.TCPListener).File()
+	assert.NilError(t, err)
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	assert.NilError(t, err)
+
+	env := map[string]string{
+		"LISTEN_PID":     strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS":     "1",
+		"LISTEN_FDNAMES": "api",
+	}
+	listeners, err := systemdListeners(func(name string) string { return env[name] }, fd)
+	assert.NilError(t, err)
+	ln, err := listeners.take("api")
+	assert.NilError(t, err)
+	defer ln.Close()
+	assert.Equal(t, tcp.Addr().String(), ln.Addr().String())
+
+	_, err = listeners.take("")
+	assert.ErrorContains(t, err, "no sockets passed by systemd")
+
+	// Sockets passed to another process are ignored
+	env["LISTEN_PID"] = "1"
+	listeners, err = systemdListeners(func(name string) string { return env[name] }, fd)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(listeners.listeners))
+}
+
+func TestActivatedListenersTake(t *testing.T) {
+	first, second := &net.TCPListener{}, &net.TCPListener{}
+	listeners := &activatedListeners{listeners: []*activatedListener{
+		{name: "api", listener: first},
+		{name: "redirect", listener: second},
+	}}
+
+	ln, err := listeners.take("redirect")
+	assert.NilError(t, err)
+	assert.Equal(t, net.Listener(second), ln)
+
+	_, err = listeners.take("redirect")
+	assert.ErrorContains(t, err, `no socket named "redirect" passed by systemd`)
+
+	ln, err = listeners.take("")
+	assert.NilError(t, err)
+	assert.Equal(t, net.Listener(first), ln)
+}
@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"gotest.tools/v3/assert"
+)
+
+func TestHandler(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := New(buf, "json", slog.LevelInfo).With(slog.String("component", "test"))
+
+	tp := sdktrace.NewTracerProvider()
+	defer tp.Shutdown(context.Background())
+	ctx, span := tp.Tracer("test").Start(WithRequestID(context.Background(), "abc123"), "test")
+	defer span.End()
+
+	logger.InfoContext(ctx, "hello")
+	record := make(map[string]string)
+	assert.NilError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "hello", record["msg"])
+	assert.Equal(t, "test", record["component"])
+	assert.Equal(t, "abc123", record["request_id"])
+	assert.Equal(t, span.SpanContext().TraceID().String(), record["trace_id"])
+	assert.Equal(t, span.SpanContext().SpanID().String(), record["span_id"])
+
+	buf.Reset()
+	logger.DebugContext(ctx, "hidden")
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestHandlerWithoutContext(t *testing.T) {
+	buf := new(bytes.Buffer)
+	New(buf, "json", slog.LevelInfo).Info("hello")
+	record := make(map[string]string)
+	assert.NilError(t, json.Unmarshal(buf.Bytes(), &record))
+	_, found := record["request_id"]
+	assert.Assert(t, !found)
+	_, found = record["trace_id"]
+	assert.Assert(t, !found)
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("warn")
+	assert.NilError(t, err)
+	assert.Equal(t, slog.LevelWarn, level)
+	_, err = ParseLevel("verbose")
+	assert.Assert(t, err != nil)
+}
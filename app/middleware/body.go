@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+)
+
+// LimitBody caps the size of request bodies, so that reading them fails with
+// an *http.MaxBytesError instead of buffering arbitrary amounts of data.
+func LimitBody(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			WriteError(w, r, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BodyErrorStatus returns the status for an error reading a request body:
+// 413 when it exceeds the limit, and 400 otherwise.
+func BodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLimitBody(t *testing.T) {
+	handler := LimitBody(4, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			w.WriteHeader(BodyErrorStatus(err))
+		}
+	}))
+
+	for body, status := range map[string]int{"1234": http.StatusOK, "12345": http.StatusRequestEntityTooLarge} {
+		for _, length := range []int64{int64(len(body)), -1} {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			r.ContentLength = length
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, status, w.Code, "body %q with length %d", body, length)
+		}
+	}
+	assert.Equal(t, http.StatusBadRequest, BodyErrorStatus(io.ErrUnexpectedEOF))
+}
@@ -0,0 +1,319 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	ZstdEncoding   = "zstd"
+	BrotliEncoding = "br"
+	GzipEncoding   = "gzip"
+)
+
+// Encodings lists the supported content codings, by order of preference.
+var Encodings = []string{ZstdEncoding, BrotliEncoding, GzipEncoding}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// The levels favor speed, as responses are compressed on the fly.
+var newEncoders = map[string]func() encoder{
+	ZstdEncoding: func() encoder {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return enc
+	},
+	BrotliEncoding: func() encoder {
+		return brotli.NewWriterLevel(nil, 4)
+	},
+	GzipEncoding: func() encoder {
+		enc, _ := gzip.NewWriterLevel(nil, 5)
+		return enc
+	},
+}
+
+// Compression encodes responses with the best coding accepted by the client,
+// when they are at least minSize bytes long and of a compressible type.
+type Compression struct {
+	encodings []string
+	minSize   int
+	pools     map[string]*sync.Pool
+}
+
+// NewCompression enables the given encodings, in order of preference; none
+// disables compression.
+func NewCompression(encodings []string, minSize int) (*Compression, error) {
+	c := &Compression{encodings: encodings, minSize: minSize, pools: make(map[string]*sync.Pool)}
+	for _, encoding := range encodings {
+		newEncoder, ok := newEncoders[encoding]
+		if !ok {
+			return nil, fmt.Errorf("unsupported encoding %q", encoding)
+		}
+		c.pools[encoding] = &sync.Pool{New: func() any { return newEncoder() }}
+	}
+	return c, nil
+}
+
+func (c *Compression) Wrap(next http.Handler) http.Handler {
+	if len(c.encodings) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddVary(w.Header(), "Accept-Encoding")
+		ifNoneMatch := r.Header.Get("If-None-Match")
+		r = withoutEncodingTags(r)
+		encoding := NegotiateEncoding(r.Header.Get("Accept-Encoding"), c.encodings)
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, c: c, encoding: encoding, ifNoneMatch: ifNoneMatch}
+		// Deferred so that the encoder goes back to the pool when the handler
+		// panics, like with http.ErrAbortHandler
+		completed := false
+		defer func() {
+			cw.close(completed)
+		}()
+		next.ServeHTTP(cw, r)
+		completed = true
+	})
+}
+
+// encodingTags removes the suffix that compressed responses add to strong
+// ETags.
+var encodingTags = strings.NewReplacer(`-`+ZstdEncoding+`"`, `"`, `-`+BrotliEncoding+`"`, `"`, `-`+GzipEncoding+`"`, `"`)
+
+// withoutEncodingTags removes the encoding from the ETags of the conditional
+// headers, so that handlers compare them with the ETags they set.
+func withoutEncodingTags(r *http.Request) *http.Request {
+	var header http.Header
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Range"} {
+		value := r.Header.Get(name)
+		if stripped := encodingTags.Replace(value); stripped != value {
+			if header == nil {
+				header = r.Header.Clone()
+			}
+			header.Set(name, stripped)
+		}
+	}
+	if header == nil {
+		return r
+	}
+	r = r.WithContext(r.Context())
+	r.Header = header
+	return r
+}
+
+// NegotiateEncoding returns the offer with the highest quality in the
+// Accept-Encoding header, the first one winning ties, or "" when the client
+// accepts none of them.
+func NegotiateEncoding(header string, offers []string) string {
+	best, bestQuality := "", 0.0
+	for _, offer := range offers {
+		if q := encodingQuality(header, offer); q > bestQuality {
+			best, bestQuality = offer, q
+		}
+	}
+	return best
+}
+
+func encodingQuality(header, coding string) float64 {
+	wildcard := 0.0
+	for _, entry := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(entry, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case coding:
+			return q
+		case "*":
+			wildcard = q
+		}
+	}
+	return wildcard
+}
+
+// AddVary adds a header name to Vary unless it is already listed.
+func AddVary(h http.Header, name string) {
+	for _, value := range h.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// compressible reports whether the media type benefits from compression,
+// unlike images or fonts that are already compressed.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/javascript",
+		"application/xml", "application/wasm", "image/svg+xml", "image/x-icon":
+		return true
+	}
+	return false
+}
+
+// compressWriter buffers the beginning of the response until it is known
+// whether it is large enough to be compressed.
+type compressWriter struct {
+	http.ResponseWriter
+	c        *Compression
+	encoding string
+	status   int
+	buf      []byte
+	enc      encoder
+	started  bool
+	// ifNoneMatch holds the ETags cached by the client, with their encoding
+	ifNoneMatch string
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if status < http.StatusOK || w.started {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if w.started {
+		if w.enc != nil {
+			return w.enc.Write(data)
+		}
+		return w.ResponseWriter.Write(data)
+	}
+	w.buf = append(w.buf, data...)
+	if len(w.buf) >= w.c.minSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Flush sends the buffered data, compressing it when the type allows, as
+// the response is being streamed.
+func (w *compressWriter) Flush() {
+	if !w.started {
+		w.start(true)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// start writes the headers and the buffered data, through an encoder when
+// compress is set and the response qualifies.
+func (w *compressWriter) start(compress bool) error {
+	w.started = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		// Sniff the type of the data as the server would, not of its encoding
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	switch w.status {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		compress = false
+	}
+	etag, tagged := encodedTag(h.Get("ETag"), w.encoding)
+	if w.status == http.StatusNotModified && tagged && strings.Contains(w.ifNoneMatch, etag) {
+		// The validated response was compressed, so it is identified by the
+		// same ETag as the one cached by the client
+		h.Set("ETag", etag)
+	}
+	if compress && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		// The encoded representation is not byte-for-byte the same, so
+		// strong ETags get the encoding, which is removed from requests
+		if tagged {
+			h.Set("ETag", etag)
+		}
+		w.enc = w.c.pools[w.encoding].Get().(encoder)
+		w.enc.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// encodedTag returns the strong ETag with the encoding as suffix, or false
+// for weak or missing ETags.
+func encodedTag(etag, encoding string) (string, bool) {
+	if len(etag) < 2 || !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		return "", false
+	}
+	return etag[:len(etag)-1] + "-" + encoding + `"`, true
+}
+
+// close sends responses smaller than the threshold as they are and finishes
+// the encoded stream of the others. After a panic, nothing more is written to
+// the aborted response and the encoder is only released.
+func (w *compressWriter) close(completed bool) {
+	if completed && !w.started && (w.status != 0 || len(w.buf) > 0) {
+		w.start(false)
+	}
+	if w.enc != nil {
+		if completed {
+			w.enc.Close()
+		}
+		w.enc.Reset(io.Discard)
+		w.c.pools[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
@@ -0,0 +1,279 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"gotest.tools/v3/assert"
+)
+
+func decode(t *testing.T, encoding string, body io.Reader) string {
+	t.Helper()
+	var r io.Reader
+	switch encoding {
+	case GzipEncoding:
+		gz, err := gzip.NewReader(body)
+		assert.NilError(t, err)
+		r = gz
+	case BrotliEncoding:
+		r = brotli.NewReader(body)
+	case ZstdEncoding:
+		dec, err := zstd.NewReader(body)
+		assert.NilError(t, err)
+		defer dec.Close()
+		r = dec
+	default:
+		r = body
+	}
+	data, err := io.ReadAll(r)
+	assert.NilError(t, err)
+	return string(data)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for header, expected := range map[string]string{
+		"":                           "",
+		"gzip, deflate, br, zstd":    ZstdEncoding,
+		"gzip, br":                   BrotliEncoding,
+		"gzip;q=1, br;q=0.5":         GzipEncoding,
+		"GZIP":                       GzipEncoding,
+		"*":                          ZstdEncoding,
+		"*;q=0.1, zstd;q=0, br;q=0":  GzipEncoding,
+		"identity":                   "",
+		"gzip;q=0":                   "",
+		"deflate, br ; q=0.8, gzip ": GzipEncoding,
+	} {
+		assert.Equal(t, expected, NegotiateEncoding(header, Encodings), header)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	body := strings.Repeat(`{"title":"Buy milk"}`, 100)
+	compression, err := NewCompression(Encodings, 1024)
+	assert.NilError(t, err)
+	handler := compression.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"1"`)
+		w.Header().Set("Content-Type", "application/json")
+		size := len(body)
+		if r.URL.Query().Has("small") {
+			size = 10
+		}
+		// Written in pieces to go through the buffer
+		for i := 0; i < size; i += 100 {
+			io.WriteString(w, body[i:min(i+100, size)])
+		}
+	}))
+
+	for _, encoding := range Encodings {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", encoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, encoding, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		assert.Equal(t, `"1-`+encoding+`"`, w.Header().Get("ETag"))
+		assert.Assert(t, w.Body.Len() < len(body))
+		assert.Equal(t, body, decode(t, encoding, w.Body))
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/?small", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+	assert.Equal(t, body[:10], w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, body, w.Body.String())
+}
+
+func TestCompressionSkipped(t *testing.T) {
+	compression, err := NewCompression([]string{GzipEncoding}, 0)
+	assert.NilError(t, err)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+	for name, h := range map[string]http.HandlerFunc{
+		"image": func(w http.ResponseWriter, r *http.Request) {
+			w.Write(png)
+		},
+		"encoded": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", BrotliEncoding)
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("data"))
+		},
+		"not modified": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusNotModified)
+		},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		compression.Wrap(h).ServeHTTP(w, r)
+		assert.Assert(t, w.Header().Get("Content-Encoding") != GzipEncoding, name)
+	}
+
+	_, err = NewCompression([]string{"deflate"}, 0)
+	assert.ErrorContains(t, err, `unsupported encoding "deflate"`)
+}
+
+func TestCompressionFlush(t *testing.T) {
+	compression, err := NewCompression([]string{GzipEncoding}, 1024)
+	assert.NilError(t, err)
+	flushed := make(chan string, 1)
+	handler := compression.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "first")
+		assert.NilError(t, http.NewResponseController(w).Flush())
+		flushed <- w.(*compressWriter).ResponseWriter.(*httptest.ResponseRecorder).Body.String()
+		io.WriteString(w, " second")
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Assert(t, len(<-flushed) > 0)
+	assert.Equal(t, "first second", decode(t, GzipEncoding, w.Body))
+}
+
+// poolEncoder records how the encoders taken from the pool are released.
+type poolEncoder struct {
+	encoder
+	closed   bool
+	released bool
+}
+
+func (e *poolEncoder) Close() error {
+	e.closed = true
+	return e.encoder.Close()
+}
+
+func (e *poolEncoder) Reset(w io.Writer) {
+	e.released = w == io.Discard
+	e.encoder.Reset(w)
+}
+
+func TestCompressionAborted(t *testing.T) {
+	compression, err := NewCompression([]string{GzipEncoding}, 16)
+	assert.NilError(t, err)
+	enc := &poolEncoder{encoder: newEncoders[GzipEncoding]()}
+	compression.pools[GzipEncoding].New = func() any { return enc }
+	handler := compression.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, strings.Repeat("partial ", 8))
+		panic(http.ErrAbortHandler)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/export", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	func() {
+		defer func() {
+			assert.Equal(t, http.ErrAbortHandler, recover())
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+	// The truncated stream is not terminated, but the encoder is released
+	assert.Assert(t, !enc.closed)
+	assert.Assert(t, enc.released)
+}
+
+func TestCompressionIdempotentReplay(t *testing.T) {
+	compression, err := NewCompression([]string{GzipEncoding}, 16)
+	assert.NilError(t, err)
+	payload := `{"x":"` + strings.Repeat("a", 64) + `"}`
+	handler := compression.Wrap(NewIdempotency(time.Hour).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"1"`)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, payload)
+	})))
+
+	// The replay is compressed again rather than labelled with the encoding
+	// of the stored response
+	for range 2 {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/todos", strings.NewReader("{}"))
+		r.Header.Set(IdempotencyKeyHeader, "abc")
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, GzipEncoding, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, `"1-gzip"`, w.Header().Get("ETag"))
+		assert.Equal(t, payload, decode(t, GzipEncoding, w.Body))
+	}
+}
+
+func TestCompressionConditionalHeaders(t *testing.T) {
+	compression, err := NewCompression(Encodings, 1024)
+	assert.NilError(t, err)
+	var seen http.Header
+	handler := compression.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+	}))
+
+	// Handlers get back the ETags they set
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-Match", `"1-zstd"`)
+	r.Header.Set("If-None-Match", `"abc-br", W/"def-gzip", "ghi"`)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, `"1"`, seen.Get("If-Match"))
+	assert.Equal(t, `"abc", W/"def", "ghi"`, seen.Get("If-None-Match"))
+	assert.Equal(t, `"1-zstd"`, r.Header.Get("If-Match"))
+}
+
+func TestCompressionNotModified(t *testing.T) {
+	compression, err := NewCompression(Encodings, 16)
+	assert.NilError(t, err)
+	payload := strings.Repeat("body { color: red; }\n", 8)
+	handler := compression.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"8e31544cd63a5c87"`)
+		http.ServeContent(w, r, "app.css", time.Time{}, strings.NewReader(payload))
+	}))
+	get := func(acceptEncoding, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/app.css", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Revalidating gives the ETag of the cached response
+	w := get("gzip", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, `"8e31544cd63a5c87-gzip"`, etag)
+	w = get("gzip", etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	// Responses cached before the client accepted compression keep theirs
+	w = get("", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag = w.Header().Get("ETag")
+	assert.Equal(t, `"8e31544cd63a5c87"`, etag)
+	w = get("gzip", etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+}
+
+func TestAddVary(t *testing.T) {
+	h := http.Header{}
+	h.Set("Vary", "Origin, accept-encoding")
+	AddVary(h, "Accept-Encoding")
+	AddVary(h, "Authorization")
+	assert.DeepEqual(t, []string{"Origin, accept-encoding", "Authorization"}, h.Values("Vary"))
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions lists what browsers may do from other origins. Origins are
+// like "https://app.example.com", "https://*.example.com" for any subdomain,
+// or "*" for any origin.
+type CORSOptions struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// CORS implements Cross-Origin Resource Sharing, answering preflight requests
+// and allowing browsers to read the responses of the allowed origins.
+type CORS struct {
+	origins     []string
+	anyOrigin   bool
+	methods     []string
+	headers     []string
+	anyHeader   bool
+	exposed     string
+	credentials bool
+	maxAge      string
+}
+
+func NewCORS(opts CORSOptions) *CORS {
+	c := &CORS{
+		exposed:     strings.Join(opts.ExposedHeaders, ", "),
+		credentials: opts.AllowCredentials,
+		maxAge:      strconv.Itoa(int(opts.MaxAge.Seconds())),
+	}
+	for _, origin := range opts.AllowedOrigins {
+		if origin == "*" {
+			c.anyOrigin = true
+		} else {
+			c.origins = append(c.origins, strings.ToLower(origin))
+		}
+	}
+	for _, method := range opts.AllowedMethods {
+		c.methods = append(c.methods, strings.ToUpper(method))
+	}
+	for _, header := range opts.AllowedHeaders {
+		if header == "*" {
+			c.anyHeader = true
+		} else {
+			c.headers = append(c.headers, http.CanonicalHeaderKey(header))
+		}
+	}
+	return c
+}
+
+// Enabled reports whether any origin is allowed.
+func (c *CORS) Enabled() bool {
+	return c.anyOrigin || len(c.origins) > 0
+}
+
+func (c *CORS) allowedOrigin(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.origins {
+		if allowed == origin {
+			return true
+		}
+		// "https://*.example.com" matches subdomains, not example.com itself
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok &&
+			len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) allowedHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		if header = strings.TrimSpace(header); header == "" {
+			continue
+		}
+		if !c.anyHeader && !slices.Contains(c.headers, http.CanonicalHeaderKey(header)) {
+			return false
+		}
+	}
+	return true
+}
+
+// setOrigin allows the origin to read the response. Browsers reject
+// credentials along with the "*" wildcard, so they are only allowed for
+// listed origins.
+func (c *CORS) setOrigin(h http.Header, origin string) {
+	if c.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// Wrap answers preflight requests of allowed origins and adds the CORS
+// headers to the responses of next.
+func (c *CORS) Wrap(next http.Handler) http.Handler {
+	if !c.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		AddVary(h, "Origin")
+		origin := r.Header.Get("Origin")
+		method := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || method == "" {
+			if origin != "" && c.allowedOrigin(origin) {
+				c.setOrigin(h, origin)
+				if c.exposed != "" {
+					h.Set("Access-Control-Expose-Headers", c.exposed)
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		AddVary(h, "Access-Control-Request-Method")
+		AddVary(h, "Access-Control-Request-Headers")
+		requested := r.Header.Get("Access-Control-Request-Headers")
+		switch {
+		case origin == "" || !c.allowedOrigin(origin):
+			WriteError(w, r, "Origin not allowed", http.StatusForbidden)
+		case !slices.Contains(c.methods, method):
+			WriteError(w, r, "Method not allowed", http.StatusForbidden)
+		case !c.allowedHeaders(requested):
+			WriteError(w, r, "Headers not allowed", http.StatusForbidden)
+		default:
+			c.setOrigin(h, origin)
+			h.Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+			if requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested)
+			}
+			h.Set("Access-Control-Max-Age", c.maxAge)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
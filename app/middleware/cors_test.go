@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func corsRequest(method, origin string, headers ...string) *http.Request {
+	r := httptest.NewRequest(method, "/api/v1/todos", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	for i := 0; i < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	return r
+}
+
+func TestCORS(t *testing.T) {
+	cors := NewCORS(CORSOptions{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+		AllowedMethods:   []string{"GET", "post"},
+		AllowedHeaders:   []string{"content-type", "X-API-Key"},
+		ExposedHeaders:   []string{"ETag", "X-Request-ID"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	calls := 0
+	handler := cors.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(corsRequest(http.MethodOptions, "https://app.example.com",
+		"Access-Control-Request-Method", "POST", "Access-Control-Request-Headers", "content-type,x-api-key"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET, POST", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "content-type,x-api-key", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+	assert.DeepEqual(t, []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}, w.Header().Values("Vary"))
+	assert.Equal(t, 0, calls)
+
+	for name, r := range map[string]*http.Request{
+		"origin":  corsRequest(http.MethodOptions, "https://evil.example.com", "Access-Control-Request-Method", "GET"),
+		"method":  corsRequest(http.MethodOptions, "https://app.example.com", "Access-Control-Request-Method", "DELETE"),
+		"headers": corsRequest(http.MethodOptions, "https://app.example.com", "Access-Control-Request-Method", "GET", "Access-Control-Request-Headers", "X-Custom"),
+	} {
+		w := serve(r)
+		assert.Equal(t, http.StatusForbidden, w.Code, name)
+		assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"), name)
+	}
+
+	w = serve(corsRequest(http.MethodGet, "https://eu.example.org"))
+	assert.Equal(t, "https://eu.example.org", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "ETag, X-Request-ID", w.Header().Get("Access-Control-Expose-Headers"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+
+	// The wildcard only matches subdomains
+	for _, origin := range []string{"https://example.org", "http://eu.example.org", ""} {
+		w = serve(corsRequest(http.MethodGet, origin))
+		assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"), origin)
+	}
+	assert.Equal(t, 4, calls)
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	cors := NewCORS(CORSOptions{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}, AllowedHeaders: []string{"*"}, AllowCredentials: true})
+	handler := cors.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, corsRequest(http.MethodOptions, "https://any.example.net",
+		"Access-Control-Request-Method", "GET", "Access-Control-Request-Headers", "X-Custom"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Credentials"))
+
+	disabled := NewCORS(CORSOptions{AllowedMethods: []string{"GET"}})
+	assert.Assert(t, !disabled.Enabled())
+	w = httptest.NewRecorder()
+	disabled.Wrap(http.NotFoundHandler()).ServeHTTP(w, corsRequest(http.MethodGet, "https://any.example.net"))
+	assert.Equal(t, "", w.Header().Get("Vary"))
+}
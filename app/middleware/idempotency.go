@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// unreplayed lists the headers that describe the exchange rather than the
+// response, which retries get anew.
+var unreplayed = []string{
+	RequestIDHeader, "Connection", "Keep-Alive", "Transfer-Encoding", "Trailer",
+	"Upgrade", "Content-Length", "Content-Encoding", "Date",
+}
+
+type storedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	response    *storedResponse
+	expires     time.Time
+}
+
+// Idempotency remembers the responses of requests sent with an
+// Idempotency-Key header, so retries are answered without executing the
+// handler again. The responses are kept in memory, so retries reaching
+// another process are executed again.
+type Idempotency struct {
+	ttl     time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	sweep   time.Time
+}
+
+func NewIdempotency(ttl time.Duration) *Idempotency {
+	return &Idempotency{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+func (i *Idempotency) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			WriteError(w, r, "Idempotency key too long", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			WriteError(w, r, err.Error(), BodyErrorStatus(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := Principal(r.Context()) + "|" + key
+		fp := fingerprint(r, body)
+		entry, found := i.reserve(scope, fp)
+		switch {
+		case entry.fingerprint != fp:
+			WriteError(w, r, "Idempotency key already used for a different request", http.StatusUnprocessableEntity)
+			return
+		case found && entry.response == nil:
+			w.Header().Set("Retry-After", "1")
+			WriteError(w, r, "A request with the same idempotency key is in progress", http.StatusConflict)
+			return
+		case found:
+			for name, values := range entry.response.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.response.status)
+			w.Write(entry.response.body)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, header: make(http.Header), status: http.StatusOK}
+		completed := false
+		defer func() {
+			i.complete(scope, recorder, completed)
+		}()
+		next.ServeHTTP(recorder, r)
+		recorder.WriteHeader(http.StatusOK)
+		completed = true
+	})
+}
+
+// reserve returns the entry for the given key, creating an in-flight one when
+// it doesn't exist or has expired.
+func (i *Idempotency) reserve(key, fingerprint string) (*idempotencyEntry, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := i.now()
+	i.evict(now)
+	if entry, found := i.entries[key]; found && now.Before(entry.expires) {
+		return entry, true
+	}
+	entry := &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(i.ttl)}
+	i.entries[key] = entry
+	return entry, false
+}
+
+// complete stores the response for future retries. Failed requests are
+// forgotten so they can be retried.
+func (i *Idempotency) complete(key string, recorder *responseRecorder, completed bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if !completed || recorder.status >= http.StatusInternalServerError {
+		delete(i.entries, key)
+		return
+	}
+	if entry, found := i.entries[key]; found {
+		entry.response = &storedResponse{
+			status: recorder.status,
+			header: replayable(recorder.header),
+			body:   recorder.body.Bytes(),
+		}
+		entry.expires = i.now().Add(i.ttl)
+	}
+}
+
+// replayable copies the headers set by the handler, except those of the
+// exchange.
+func replayable(header http.Header) http.Header {
+	stored := header.Clone()
+	for _, name := range unreplayed {
+		stored.Del(name)
+	}
+	return stored
+}
+
+func (i *Idempotency) evict(now time.Time) {
+	if now.Sub(i.sweep) < time.Minute {
+		return
+	}
+	i.sweep = now
+	for key, entry := range i.entries {
+		if entry.response != nil && now.After(entry.expires) {
+			delete(i.entries, key)
+		}
+	}
+}
+
+func fingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder keeps the headers set by the handler apart from those of
+// the writer, which the middleware around it may change once the response is
+// sent, like when compressing it.
+type responseRecorder struct {
+	http.ResponseWriter
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.status = status
+	h := r.ResponseWriter.Header()
+	for name, values := range r.header {
+		h[name] = values
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func sendIdempotent(handler http.Handler, key, body string) *http.Response {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos", strings.NewReader(body))
+	r.Header.Set(IdempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	count := 0
+	handler := NewIdempotency(time.Hour).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		data, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(data)
+	}))
+
+	first := sendIdempotent(handler, "abc", `{"title":"test"}`)
+	assert.Equal(t, http.StatusCreated, first.StatusCode)
+
+	second := sendIdempotent(handler, "abc", `{"title":"test"}`)
+	assert.Equal(t, http.StatusCreated, second.StatusCode)
+	assert.Equal(t, "true", second.Header.Get("Idempotent-Replayed"))
+	assert.Equal(t, "application/json", second.Header.Get("Content-Type"))
+	data, _ := io.ReadAll(second.Body)
+	assert.Equal(t, `{"title":"test"}`, string(data))
+
+	mismatch := sendIdempotent(handler, "abc", `{"title":"other"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, mismatch.StatusCode)
+
+	assert.Equal(t, http.StatusCreated, sendIdempotent(handler, "def", `{"title":"other"}`).StatusCode)
+	assert.Equal(t, 2, count)
+}
+
+func TestIdempotencyReplayHeaders(t *testing.T) {
+	count := 0
+	idem := NewIdempotency(time.Hour).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		w.Header().Set("Location", "/api/v1/todos/1")
+		w.Header().Set(RequestIDHeader, "from-handler")
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	// Headers set around the handler belong to each request
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(RequestIDHeader, "request-"+strconv.Itoa(count+1))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(10-count))
+		idem.ServeHTTP(w, r)
+	})
+
+	first := sendIdempotent(handler, "abc", "{}")
+	assert.Equal(t, "from-handler", first.Header.Get(RequestIDHeader))
+	second := sendIdempotent(handler, "abc", "{}")
+	assert.Equal(t, 1, count)
+	assert.Equal(t, "true", second.Header.Get("Idempotent-Replayed"))
+	assert.Equal(t, "/api/v1/todos/1", second.Header.Get("Location"))
+	assert.Equal(t, "request-2", second.Header.Get(RequestIDHeader))
+	assert.Equal(t, "9", second.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "", second.Header.Get("Connection"))
+}
+
+func TestIdempotencyExpiration(t *testing.T) {
+	now := time.Now()
+	count := 0
+	idem := NewIdempotency(time.Minute)
+	idem.now = func() time.Time { return now }
+	handler := idem.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+	}))
+
+	sendIdempotent(handler, "abc", "{}")
+	sendIdempotent(handler, "abc", "{}")
+	assert.Equal(t, 1, count)
+
+	now = now.Add(2 * time.Minute)
+	sendIdempotent(handler, "abc", "{}")
+	assert.Equal(t, 2, count)
+}
+
+func TestIdempotencyServerError(t *testing.T) {
+	count := 0
+	handler := NewIdempotency(time.Hour).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	sendIdempotent(handler, "abc", "{}")
+	sendIdempotent(handler, "abc", "{}")
+	assert.Equal(t, 2, count)
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := NewIdempotency(time.Hour).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, http.StatusCreated, sendIdempotent(handler, "abc", "{}").StatusCode)
+	}()
+
+	<-started
+	resp := sendIdempotent(handler, "abc", "{}")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, http.StatusCreated, sendIdempotent(handler, "abc", "{}").StatusCode)
+}
@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prombridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+const (
+	PrometheusExporter = "prometheus"
+	OTLPExporter       = "otlp"
+)
+
+// ParseMetricExporters parses the value of OTEL_METRICS_EXPORTER, a comma
+// separated list with "prometheus", "otlp" or "none".
+func ParseMetricExporters(value string) []string {
+	exporters := make([]string, 0)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch entry {
+		case PrometheusExporter, OTLPExporter:
+			if !slices.Contains(exporters, entry) {
+				exporters = append(exporters, entry)
+			}
+		case "", "none":
+		default:
+			slog.Warn("ignoring unknown metrics exporter", slog.String("exporter", entry))
+		}
+	}
+	return exporters
+}
+
+// WithMetricExporters selects where metrics are published: "prometheus" enables
+// MetricsHandler and "otlp" pushes them through OpenTelemetry.
+func WithMetricExporters(exporters []string) ObserverOption {
+	return func(c *observerConfig) {
+		c.exporters = exporters
+	}
+}
+
+func withMetricReader(reader sdkmetric.Reader) ObserverOption {
+	return func(c *observerConfig) {
+		c.metricReader = reader
+	}
+}
+
+func newMeterProvider(ctx context.Context, cfg *observerConfig) *sdkmetric.MeterProvider {
+	opts := []sdkmetric.Option{sdkmetric.WithResource(cfg.resource)}
+	if cfg.metricReader != nil {
+		opts = append(opts, sdkmetric.WithReader(cfg.metricReader))
+	}
+	if slices.Contains(cfg.exporters, OTLPExporter) {
+		if exp, err := otlpmetricgrpc.New(ctx); err == nil {
+			var readerOpts []sdkmetric.PeriodicReaderOption
+			if producer := prometheusProducer(cfg.exporters); producer != nil {
+				readerOpts = append(readerOpts, sdkmetric.WithProducer(producer))
+			}
+			opts = append(opts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp, readerOpts...)))
+		} else {
+			slog.Warn("Cannot Initialize OpenTelemetry metrics via gRPC", slog.String("error", err.Error()))
+		}
+	}
+	mp := sdkmetric.NewMeterProvider(opts...)
+	otel.SetMeterProvider(mp)
+	return mp
+}
+
+// prometheusProducer bridges the collectors registered with Prometheus, like
+// the database and business metrics, to the OTLP exporter when it is the
+// only one, as nothing would scrape them otherwise.
+func prometheusProducer(exporters []string) sdkmetric.Producer {
+	if slices.Contains(exporters, PrometheusExporter) {
+		return nil
+	}
+	return prombridge.NewMetricProducer(prombridge.WithGatherer(prometheus.DefaultGatherer))
+}
+
+// serverMetrics are the HTTP server instruments defined by the OpenTelemetry
+// semantic conventions.
+type serverMetrics struct {
+	duration       metric.Float64Histogram
+	activeRequests metric.Int64UpDownCounter
+	responseSize   metric.Int64Histogram
+}
+
+func newServerMetrics(mp metric.MeterProvider) *serverMetrics {
+	meter := mp.Meter("todo-api/app/middleware")
+	m := &serverMetrics{}
+	var err error
+	if m.duration, err = meter.Float64Histogram("http.server.request.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of HTTP server requests."),
+		metric.WithExplicitBucketBoundaries(0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10),
+	); err != nil {
+		slog.Warn("cannot create instrument", slog.String("error", err.Error()))
+	}
+	if m.activeRequests, err = meter.Int64UpDownCounter("http.server.active_requests",
+		metric.WithUnit("{request}"),
+		metric.WithDescription("Number of active HTTP server requests."),
+	); err != nil {
+		slog.Warn("cannot create instrument", slog.String("error", err.Error()))
+	}
+	if m.responseSize, err = meter.Int64Histogram("http.server.response.body.size",
+		metric.WithUnit("By"),
+		metric.WithDescription("Size of HTTP server response bodies."),
+	); err != nil {
+		slog.Warn("cannot create instrument", slog.String("error", err.Error()))
+	}
+	return m
+}
+
+func scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (m *serverMetrics) start(ctx context.Context, r *http.Request) {
+	m.activeRequests.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("http.request.method", r.Method),
+		attribute.String("url.scheme", scheme(r)),
+	))
+}
+
+func (m *serverMetrics) end(ctx context.Context, r *http.Request, route string, recorder *StatusRecorder, seconds float64) {
+	m.activeRequests.Add(ctx, -1, metric.WithAttributes(
+		attribute.String("http.request.method", r.Method),
+		attribute.String("url.scheme", scheme(r)),
+	))
+	attrs := metric.WithAttributes(
+		attribute.String("http.request.method", r.Method),
+		attribute.String("http.route", route),
+		attribute.Int("http.response.status_code", recorder.Status),
+		attribute.String("url.scheme", scheme(r)),
+	)
+	m.duration.Record(ctx, seconds, attrs)
+	m.responseSize.Record(ctx, int64(recorder.Size), attrs)
+}
@@ -4,20 +4,29 @@ import (
 	"context"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+	"todo-api/app/logging"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// UnmatchedRoute is the route label of requests not handled by any pattern.
+const UnmatchedRoute = "unmatched"
+
 type StatusRecorder struct {
 	http.ResponseWriter
 	Status int
+	Size   int
 }
 
 func (r *StatusRecorder) WriteHeader(status int) {
@@ -25,66 +34,211 @@ func (r *StatusRecorder) WriteHeader(status int) {
 	r.ResponseWriter.WriteHeader(status)
 }
 
+func (r *StatusRecorder) Write(data []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(data)
+	r.Size += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+type observerConfig struct {
+	latencyBuckets []float64
+	sizeBuckets    []float64
+	exporters      []string
+	metricReader   sdkmetric.Reader
+	serviceName    string
+	serviceVersion string
+	environment    string
+	sampleRatio    float64
+	resource       *resource.Resource
+}
+
+type ObserverOption func(*observerConfig)
+
+// WithLatencyBuckets overrides the buckets of the request duration histogram.
+func WithLatencyBuckets(buckets []float64) ObserverOption {
+	return func(c *observerConfig) {
+		if len(buckets) > 0 {
+			c.latencyBuckets = buckets
+		}
+	}
+}
+
+// WithSizeBuckets overrides the buckets of the response size histogram.
+func WithSizeBuckets(buckets []float64) ObserverOption {
+	return func(c *observerConfig) {
+		if len(buckets) > 0 {
+			c.sizeBuckets = buckets
+		}
+	}
+}
+
 type Observer struct {
+	mux              *http.ServeMux
 	handler          http.Handler
 	totalRequests    *prometheus.CounterVec
 	latencyHistogram *prometheus.HistogramVec
+	sizeHistogram    *prometheus.HistogramVec
+	inFlight         prometheus.Gauge
 	traceProvider    *sdktrace.TracerProvider
+	meterProvider    *sdkmetric.MeterProvider
+	serverMetrics    *serverMetrics
+	prometheus       bool
 }
 
-func newTraceProvider(ctx context.Context) *sdktrace.TracerProvider {
-	tp := sdktrace.NewTracerProvider()
-	otel.SetTracerProvider(tp)
-	exp, err := otlptracegrpc.New(ctx)
-	if err != nil {
-		slog.Warn("Cannot Initialize OpenTelemetry tracing via gRPC", slog.String("error", err.Error()))
-		return tp
+func NewObserver(ctx context.Context, mux *http.ServeMux, opts ...ObserverOption) *Observer {
+	cfg := &observerConfig{
+		latencyBuckets: prometheus.DefBuckets,
+		sizeBuckets:    prometheus.ExponentialBuckets(100, 10, 7),
+		exporters:      []string{PrometheusExporter},
+		serviceName:    "todo-api",
+		sampleRatio:    1,
 	}
-	bsp := sdktrace.NewBatchSpanProcessor(exp)
-	tp.RegisterSpanProcessor(bsp)
-	return tp
-}
-
-func NewObserver(ctx context.Context, mux *http.ServeMux) *Observer {
-	mux.Handle("/metrics", promhttp.Handler())
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	cfg.resource = newResource(ctx, cfg)
 	obs := &Observer{
-		handler:       otelhttp.NewHandler(mux, "app"),
-		traceProvider: newTraceProvider(ctx),
+		mux:           mux,
+		prometheus:    slices.Contains(cfg.exporters, PrometheusExporter),
+		traceProvider: newTraceProvider(ctx, cfg),
+		meterProvider: newMeterProvider(ctx, cfg),
 		totalRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "http_requests_total",
 			Help: "Total number of HTTP requests",
 		}, []string{"method", "route", "status"}),
 		latencyHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
-			Name: "http_request_duration_seconds",
-			Help: "Time (in seconds) spent serving HTTP requests",
+			Name:    "http_request_duration_seconds",
+			Help:    "Time (in seconds) spent serving HTTP requests",
+			Buckets: cfg.latencyBuckets,
+		}, []string{"method", "route", "status"}),
+		sizeHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_response_size_bytes",
+			Help:    "Size (in bytes) of the HTTP responses",
+			Buckets: cfg.sizeBuckets,
 		}, []string{"method", "route", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of HTTP requests being served",
+		}),
 	}
+	obs.serverMetrics = newServerMetrics(obs.meterProvider)
+	// The server metrics are recorded by observe with the route as attribute
+	obs.handler = otelhttp.NewHandler(http.HandlerFunc(obs.observe), "app",
+		otelhttp.WithMeterProvider(noop.NewMeterProvider()))
 	if err := prometheus.Register(obs.totalRequests); err != nil {
 		slog.Warn("cannot register", slog.String("metric", "totalRequests"))
 	}
 	if err := prometheus.Register(obs.latencyHistogram); err != nil {
 		slog.Warn("cannot register", slog.String("metric", "latencyHistogram"))
 	}
+	if err := prometheus.Register(obs.sizeHistogram); err != nil {
+		slog.Warn("cannot register", slog.String("metric", "sizeHistogram"))
+	}
+	if err := prometheus.Register(obs.inFlight); err != nil {
+		slog.Warn("cannot register", slog.String("metric", "inFlight"))
+	}
 	return obs
 }
 
+// Register adds collectors to be exposed next to the HTTP metrics.
+func (o *Observer) Register(collectors ...prometheus.Collector) {
+	for _, c := range collectors {
+		if err := prometheus.Register(c); err != nil {
+			slog.Warn("cannot register collector", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// MetricsHandler serves the metrics in the Prometheus format, or returns nil
+// when the Prometheus exporter is disabled.
+func (o *Observer) MetricsHandler() http.Handler {
+	if !o.prometheus {
+		return nil
+	}
+	return promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+}
+
+// route returns the ServeMux pattern that matches the request, so metrics
+// don't get a new time series for every ID or asset path.
+func (o *Observer) route(r *http.Request) string {
+	if _, pattern := o.mux.Handler(r); pattern != "" {
+		return pattern
+	}
+	return UnmatchedRoute
+}
+
+// catchAll reports whether the pattern matches every path, like the one of
+// the web interface, whose 404 responses are for paths that have no route.
+func catchAll(pattern string) bool {
+	if i := strings.Index(pattern, "/"); i >= 0 {
+		return pattern[i:] == "/"
+	}
+	return false
+}
+
 func (o *Observer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := requestID(r)
+	w.Header().Set(RequestIDHeader, id)
+	o.handler.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+}
+
+// observe runs within the server span, so logs can reference the trace.
+func (o *Observer) observe(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
+	route := o.route(r)
 	recorder := &StatusRecorder{
 		ResponseWriter: w,
 		Status:         200,
 	}
-	o.handler.ServeHTTP(recorder, r)
-	duration := time.Since(start)
-	slog.Info("query executed",
+	o.inFlight.Inc()
+	defer o.inFlight.Dec()
+	o.serverMetrics.start(r.Context(), r)
+	// Deferred so that requests aborted with a panic, like
+	// http.ErrAbortHandler, are still logged and counted
+	aborted := true
+	defer func() {
+		o.record(r, route, recorder, time.Since(start), aborted)
+	}()
+	o.mux.ServeHTTP(recorder, r)
+	aborted = false
+}
+
+func (o *Observer) record(r *http.Request, route string, recorder *StatusRecorder, duration time.Duration, aborted bool) {
+	if recorder.Status == http.StatusNotFound && catchAll(route) {
+		route = UnmatchedRoute
+	}
+	o.serverMetrics.end(r.Context(), r, route, recorder, duration.Seconds())
+	attrs := []any{
 		slog.String("source", r.RemoteAddr),
 		slog.String("method", r.Method),
 		slog.String("path", r.URL.Path),
+		slog.String("route", route),
 		slog.Int("status", recorder.Status),
 		slog.Duration("duration", duration),
-	)
-	o.totalRequests.WithLabelValues(r.Method, r.URL.Path, strconv.Itoa(recorder.Status)).Inc()
-	o.latencyHistogram.WithLabelValues(r.Method, r.URL.Path, strconv.Itoa(recorder.Status)).Observe(duration.Seconds())
+	}
+	if aborted {
+		attrs = append(attrs, slog.Bool("aborted", true))
+	}
+	slog.InfoContext(r.Context(), "query executed", attrs...)
+	status := strconv.Itoa(recorder.Status)
+	o.totalRequests.WithLabelValues(r.Method, route, status).Inc()
+	latency := o.latencyHistogram.WithLabelValues(r.Method, route, status)
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsSampled() {
+		// Exemplars link the histogram buckets with the traces in Tempo
+		latency.(prometheus.ExemplarObserver).ObserveWithExemplar(duration.Seconds(), prometheus.Labels{
+			"trace_id": sc.TraceID().String(),
+		})
+	} else {
+		latency.Observe(duration.Seconds())
+	}
+	o.sizeHistogram.WithLabelValues(r.Method, route, status).Observe(float64(recorder.Size))
 }
 
 func (o *Observer) Shutdown() {
@@ -93,4 +247,9 @@ func (o *Observer) Shutdown() {
 			slog.Error("cannot shutdown tracer", slog.String("error", err.Error()))
 		}
 	}
+	if o.meterProvider != nil {
+		if err := o.meterProvider.Shutdown(context.Background()); err != nil {
+			slog.Error("cannot shutdown meter", slog.String("error", err.Error()))
+		}
+	}
 }
@@ -2,35 +2,188 @@ package middleware
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+	"todo-api/app/models"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	"gotest.tools/v3/assert"
 )
 
 func TestObserver(t *testing.T) {
 	count := 0
 	router := http.NewServeMux()
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("GET /test/{id}", func(w http.ResponseWriter, r *http.Request) {
 		count++
-		if r.URL.Path == "/fail" {
-			w.WriteHeader(http.StatusBadRequest)
-		}
+		w.Write([]byte("ok"))
+	})
+	router.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+		count++
+		w.WriteHeader(http.StatusBadRequest)
 	})
 	obs := NewObserver(context.Background(), router)
 	srv := httptest.NewServer(obs)
 	defer srv.Close()
 
-	for range 5 {
-		_, err := http.Get(srv.URL + "/test")
+	for i := range 5 {
+		_, err := http.Get(fmt.Sprintf("%s/test/%d", srv.URL, i))
 		assert.NilError(t, err)
 		_, err = http.Get(srv.URL + "/fail")
 		assert.NilError(t, err)
+		_, err = http.Get(fmt.Sprintf("%s/missing/%d", srv.URL, i))
+		assert.NilError(t, err)
 	}
 
 	assert.Equal(t, 10, count)
-	assert.Equal(t, float64(5), testutil.ToFloat64(obs.totalRequests.WithLabelValues("GET", "/test", "200")))
+	assert.Equal(t, float64(5), testutil.ToFloat64(obs.totalRequests.WithLabelValues("GET", "GET /test/{id}", "200")))
 	assert.Equal(t, float64(5), testutil.ToFloat64(obs.totalRequests.WithLabelValues("GET", "/fail", "400")))
+	assert.Equal(t, float64(5), testutil.ToFloat64(obs.totalRequests.WithLabelValues("GET", UnmatchedRoute, "404")))
+	assert.Equal(t, 3, testutil.CollectAndCount(obs.sizeHistogram, "http_response_size_bytes"))
+	assert.Equal(t, float64(0), testutil.ToFloat64(obs.inFlight))
+}
+
+func TestObserverAborted(t *testing.T) {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /export", func(w http.ResponseWriter, r *http.Request) {
+		// The recorder lets handlers reach the connection
+		assert.NilError(t, http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Minute)))
+		w.Write([]byte("partial"))
+		panic(http.ErrAbortHandler)
+	})
+	obs := NewObserver(context.Background(), router)
+	srv := httptest.NewServer(obs)
+
+	resp, err := http.Get(srv.URL + "/export")
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	assert.Assert(t, err != nil)
+	// Waits for the handler to return
+	srv.Close()
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(obs.totalRequests.WithLabelValues("GET", "GET /export", "200")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(obs.inFlight))
+}
+
+func TestObserverRequestID(t *testing.T) {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /fail", func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, r, "something went wrong", http.StatusInternalServerError)
+	})
+	obs := NewObserver(context.Background(), router)
+
+	r := httptest.NewRequest(http.MethodGet, "/fail", nil)
+	r.Header.Set(RequestIDHeader, "client-id-1")
+	w := httptest.NewRecorder()
+	obs.ServeHTTP(w, r)
+	assert.Equal(t, "client-id-1", w.Header().Get(RequestIDHeader))
+	body := models.Error{}
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&body))
+	assert.Equal(t, "something went wrong", body.Error)
+	assert.Equal(t, "client-id-1", body.RequestID)
+
+	r = httptest.NewRequest(http.MethodGet, "/fail", nil)
+	r.Header.Set(RequestIDHeader, "invalid id\n")
+	w = httptest.NewRecorder()
+	obs.ServeHTTP(w, r)
+	id := w.Header().Get(RequestIDHeader)
+	assert.Equal(t, 32, len(id))
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&body))
+	assert.Equal(t, id, body.RequestID)
+}
+
+func TestObserverOTelMetrics(t *testing.T) {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /todos/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	reader := sdkmetric.NewManualReader()
+	obs := NewObserver(context.Background(), router, WithMetricExporters(nil), withMetricReader(reader))
+	defer obs.meterProvider.Shutdown(context.Background())
+
+	for _, path := range []string{"/todos/1", "/todos/2", "/metrics"} {
+		w := httptest.NewRecorder()
+		obs.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	rm := metricdata.ResourceMetrics{}
+	assert.NilError(t, reader.Collect(context.Background(), &rm))
+	assert.Equal(t, 1, len(rm.ScopeMetrics))
+	counts := make(map[string]uint64)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		if m.Name != "http.server.request.duration" {
+			continue
+		}
+		for _, dp := range m.Data.(metricdata.Histogram[float64]).DataPoints {
+			route, _ := dp.Attributes.Value("http.route")
+			status, _ := dp.Attributes.Value("http.response.status_code")
+			counts[fmt.Sprintf("%s %d", route.AsString(), status.AsInt64())] = dp.Count
+		}
+	}
+	assert.DeepEqual(t, map[string]uint64{
+		"GET /todos/{id} 200":   2,
+		UnmatchedRoute + " 404": 1,
+	}, counts)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(obs.latencyHistogram)
+	mfs, err := reg.Gather()
+	assert.NilError(t, err)
+	exemplars := 0
+	for _, m := range mfs[0].GetMetric() {
+		for _, b := range m.GetHistogram().GetBucket() {
+			if e := b.GetExemplar(); e != nil {
+				assert.Equal(t, "trace_id", e.GetLabel()[0].GetName())
+				exemplars++
+			}
+		}
+	}
+	assert.Assert(t, exemplars > 0)
+}
+
+func TestParseMetricExporters(t *testing.T) {
+	assert.DeepEqual(t, []string{"prometheus", "otlp"}, ParseMetricExporters("prometheus, OTLP,prometheus"))
+	assert.DeepEqual(t, []string{}, ParseMetricExporters("none"))
+	assert.DeepEqual(t, []string{"otlp"}, ParseMetricExporters("otlp,zipkin"))
+}
+
+func TestPrometheusProducer(t *testing.T) {
+	assert.Assert(t, prometheusProducer([]string{PrometheusExporter, OTLPExporter}) == nil)
+
+	// Without the Prometheus endpoint, its collectors are pushed with OTLP
+	producer := prometheusProducer([]string{OTLPExporter})
+	assert.Assert(t, producer != nil)
+	scopes, err := producer.Produce(context.Background())
+	assert.NilError(t, err)
+	names := make([]string, 0)
+	for _, scope := range scopes {
+		for _, m := range scope.Metrics {
+			names = append(names, m.Name)
+		}
+	}
+	assert.Assert(t, slices.Contains(names, "go_goroutines"), names)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	obs := NewObserver(context.Background(), http.NewServeMux())
+	defer obs.Shutdown()
+	w := httptest.NewRecorder()
+	obs.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Assert(t, strings.Contains(w.Body.String(), "http_requests_in_flight"))
+
+	obs = NewObserver(context.Background(), http.NewServeMux(), WithMetricExporters(nil))
+	defer obs.Shutdown()
+	assert.Assert(t, obs.MetricsHandler() == nil)
 }
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+type principalKey struct{}
+
+// WithPrincipal stores the name of the authenticated user in the context.
+func WithPrincipal(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, principalKey{}, name)
+}
+
+// Principal returns the name of the authenticated user, if any.
+func Principal(ctx context.Context) string {
+	if name, ok := ctx.Value(principalKey{}).(string); ok {
+		return name
+	}
+	return ""
+}
+
+// ClientCertificate authenticates requests with a verified TLS client
+// certificate, using the common name of its subject as the principal, or
+// the whole subject when it has no common name.
+func ClientCertificate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			subject := r.TLS.VerifiedChains[0][0].Subject
+			name := subject.CommonName
+			if name == "" {
+				name = subject.String()
+			}
+			r = r.WithContext(WithPrincipal(r.Context(), name))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
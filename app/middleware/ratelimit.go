@@ -0,0 +1,297 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// APIKeyHeader carries the API key of the client, which is verified by the
+// proxies in front of the application.
+const APIKeyHeader = "X-API-Key"
+
+// RateLimit defines a token bucket that refills at Rate tokens per second and
+// holds at most Burst tokens. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit parses limits expressed as "rate:burst" (e.g. "10:20"). When
+// the burst is omitted, it matches the rate.
+func ParseRateLimit(value string) (RateLimit, error) {
+	limit := RateLimit{}
+	if value == "" {
+		return limit, nil
+	}
+	rate, burst, found := strings.Cut(value, ":")
+	var err error
+	if limit.Rate, err = strconv.ParseFloat(rate, 64); err != nil || limit.Rate < 0 {
+		return limit, fmt.Errorf("invalid rate limit %q", value)
+	}
+	if !found {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.Rate)))
+		return limit, nil
+	}
+	if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst < 1 {
+		return limit, fmt.Errorf("invalid rate limit burst %q", value)
+	}
+	return limit, nil
+}
+
+// String formats the limit as "rate:burst", or "0" when disabled.
+func (l RateLimit) String() string {
+	if l.Rate == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(l.Rate, 'f', -1, 64) + ":" + strconv.Itoa(l.Burst)
+}
+
+func (l RateLimit) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *RateLimit) UnmarshalText(text []byte) error {
+	limit, err := ParseRateLimit(string(text))
+	if err != nil {
+		return err
+	}
+	*l = limit
+	return nil
+}
+
+// ParseTrustedProxies parses a comma separated list of IP addresses or CIDRs.
+func ParseTrustedProxies(value string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimits tracks the clients of every route group and exposes the decisions
+// taken as Prometheus metrics.
+type RateLimits struct {
+	trustedProxies []netip.Prefix
+	requests       *prometheus.CounterVec
+	now            func() time.Time
+}
+
+func NewRateLimits(trustedProxies []netip.Prefix) *RateLimits {
+	return &RateLimits{
+		trustedProxies: trustedProxies,
+		now:            time.Now,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_rate_limit_requests_total",
+			Help: "Total number of HTTP requests evaluated by the rate limiter",
+		}, []string{"group", "result"}),
+	}
+}
+
+func (rl *RateLimits) Describe(ch chan<- *prometheus.Desc) {
+	rl.requests.Describe(ch)
+}
+
+func (rl *RateLimits) Collect(ch chan<- prometheus.Metric) {
+	rl.requests.Collect(ch)
+}
+
+// Group returns a limiter that keeps its own buckets for the given route group.
+func (rl *RateLimits) Group(name string, limit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		limits:  rl,
+		group:   name,
+		limit:   limit,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// ClientKey identifies the client of a request by authenticated user, API key
+// or IP address, in that order. API keys are only honored when forwarded by a
+// trusted proxy that verified them, as clients could otherwise change them to
+// get a new bucket per request, and are hashed so buckets don't hold secrets.
+func (rl *RateLimits) ClientKey(r *http.Request) string {
+	if user := Principal(r.Context()); user != "" {
+		return "user:" + user
+	}
+	if key := r.Header.Get(APIKeyHeader); key != "" && rl.trustedPeer(r) {
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:16])
+	}
+	return "ip:" + rl.clientIP(r)
+}
+
+// trustedPeer tells whether the request comes from a trusted proxy. Peers
+// connected to a Unix socket are always trusted, as they have no address and
+// the socket permissions restrict who can connect.
+func (rl *RateLimits) trustedPeer(r *http.Request) bool {
+	if unixSocket(r) {
+		return true
+	}
+	addr, err := netip.ParseAddr(peerHost(r))
+	return err == nil && rl.isTrusted(addr)
+}
+
+func peerHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the address of the peer, unless it is a trusted proxy, in
+// which case X-Forwarded-For is walked from right to left until the first
+// untrusted address.
+func (rl *RateLimits) clientIP(r *http.Request) string {
+	client := peerHost(r)
+	if addr, err := netip.ParseAddr(client); err == nil {
+		client = addr.Unmap().String()
+	}
+	if !rl.trustedPeer(r) {
+		return client
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = hop.Unmap().String()
+		if !rl.isTrusted(hop) {
+			break
+		}
+	}
+	return client
+}
+
+// unixSocket tells whether the request was received on a Unix socket.
+func unixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+func (rl *RateLimits) isTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range rl.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimiter applies a token bucket per client to the handlers it wraps.
+type RateLimiter struct {
+	limits  *RateLimits
+	group   string
+	mu      sync.Mutex
+	limit   RateLimit
+	buckets map[string]*bucket
+	sweep   time.Time
+}
+
+// SetLimit changes the limit applied to the group, keeping existing buckets.
+func (l *RateLimiter) SetLimit(limit RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+}
+
+func (l *RateLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, remaining, wait, ok := l.take(l.limits.ClientKey(r))
+		if limit.Rate == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		reset := math.Ceil((float64(limit.Burst) - remaining) / limit.Rate)
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(reset)))
+		if !ok {
+			l.limits.requests.WithLabelValues(l.group, "limited").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			WriteError(w, r, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		l.limits.requests.WithLabelValues(l.group, "allowed").Inc()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *RateLimiter) HandlerFunc(next http.HandlerFunc) http.Handler {
+	return l.Wrap(next)
+}
+
+// take consumes a token from the bucket of the client, returning the limit in
+// place, the tokens left and, when the request is rejected, how long until a
+// token becomes available.
+func (l *RateLimiter) take(key string) (RateLimit, float64, time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit.Rate == 0 {
+		return l.limit, 0, 0, true
+	}
+	now := l.limits.now()
+	l.evict(now)
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+		return l.limit, b.tokens, wait, false
+	}
+	b.tokens--
+	return l.limit, b.tokens, 0, true
+}
+
+// evict forgets the buckets that had enough time to be refilled, as they are
+// equivalent to new ones.
+func (l *RateLimiter) evict(now time.Time) {
+	if now.Sub(l.sweep) < time.Minute {
+		return
+	}
+	l.sweep = now
+	full := time.Duration(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
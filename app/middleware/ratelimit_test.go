@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := ParseRateLimit("10:20")
+	assert.NilError(t, err)
+	assert.Equal(t, RateLimit{Rate: 10, Burst: 20}, limit)
+
+	limit, err = ParseRateLimit("0.5")
+	assert.NilError(t, err)
+	assert.Equal(t, RateLimit{Rate: 0.5, Burst: 1}, limit)
+
+	_, err = ParseRateLimit("fast")
+	assert.ErrorContains(t, err, "invalid rate limit")
+	_, err = ParseRateLimit("1:0")
+	assert.ErrorContains(t, err, "invalid rate limit burst")
+}
+
+func TestRateLimitText(t *testing.T) {
+	var limit RateLimit
+	assert.NilError(t, limit.UnmarshalText([]byte("2.5:5")))
+	assert.Equal(t, RateLimit{Rate: 2.5, Burst: 5}, limit)
+	assert.Equal(t, "2.5:5", limit.String())
+	assert.Equal(t, "0", RateLimit{}.String())
+	assert.ErrorContains(t, limit.UnmarshalText([]byte("x")), "invalid rate limit")
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limits := NewRateLimits(nil)
+	limits.now = func() time.Time { return now }
+	handler := limits.Group("write", RateLimit{Rate: 1, Burst: 2}).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(addr string) *http.Response {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/todos", nil)
+		if addr != "" {
+			r.RemoteAddr = addr
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	assert.Equal(t, http.StatusOK, send("").StatusCode)
+	resp := send("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("RateLimit-Limit"))
+	assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "2", resp.Header.Get("RateLimit-Reset"))
+
+	resp = send("")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// Other clients have their own bucket
+	assert.Equal(t, http.StatusOK, send("198.51.100.9:1234").StatusCode)
+
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, send("").StatusCode)
+
+	assert.Equal(t, float64(4), testutil.ToFloat64(limits.requests.WithLabelValues("write", "allowed")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(limits.requests.WithLabelValues("write", "limited")))
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limits := NewRateLimits(nil)
+	handler := limits.Group("read", RateLimit{}).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for range 5 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/todos", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "", w.Header().Get("RateLimit-Limit"))
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	assert.NilError(t, err)
+	limits := NewRateLimits(proxies)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/todos", nil)
+	r.RemoteAddr = "203.0.113.5:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.Equal(t, "ip:203.0.113.5", limits.ClientKey(r))
+
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7, 192.168.1.1")
+	assert.Equal(t, "ip:203.0.113.7", limits.ClientKey(r))
+
+	// Proxies connected to a Unix socket have no address
+	r.RemoteAddr = "@"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.8")
+	assert.Equal(t, "ip:@", limits.ClientKey(r))
+	local := &net.UnixAddr{Name: "/run/todo/api.sock", Net: "unix"}
+	unix := r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, local))
+	assert.Equal(t, "ip:203.0.113.8", limits.ClientKey(unix))
+	unix.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "ip:@", limits.ClientKey(unix))
+
+	r = r.WithContext(WithPrincipal(r.Context(), "alice"))
+	assert.Equal(t, "user:alice", limits.ClientKey(r))
+
+	// API keys are only trusted from proxies, and never kept in clear
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/todos", nil)
+	r.RemoteAddr = "203.0.113.5:1234"
+	r.Header.Set(APIKeyHeader, "secret")
+	assert.Equal(t, "ip:203.0.113.5", limits.ClientKey(r))
+	r.RemoteAddr = "10.1.2.3:1234"
+	assert.Equal(t, "key:2bb80d537b1da3e38bd30361aa855686", limits.ClientKey(r))
+	r = r.WithContext(WithPrincipal(r.Context(), "alice"))
+	assert.Equal(t, "user:alice", limits.ClientKey(r))
+
+	_, err = ParseTrustedProxies("not-an-ip")
+	assert.ErrorContains(t, err, "invalid trusted proxy")
+}
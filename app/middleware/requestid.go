@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"todo-api/app/logging"
+	"todo-api/app/models"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// requestID returns the ID sent by the client when it is safe to log and echo,
+// or a new random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); isValidRequestID(id) {
+		return id
+	}
+	data := make([]byte, 16)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WriteError sends an error message as JSON including the ID of the request.
+func WriteError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(models.Error{
+		Error:     message,
+		RequestID: logging.RequestID(r.Context()),
+	})
+}
@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// WithServiceInfo sets the resource attributes that identify the service. The
+// standard OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence.
+func WithServiceInfo(name, version, environment string) ObserverOption {
+	return func(c *observerConfig) {
+		c.serviceName = name
+		c.serviceVersion = version
+		c.environment = environment
+	}
+}
+
+// WithSampleRatio sets the fraction of new traces to sample. Spans with a
+// remote parent follow the decision of the caller. The standard
+// OTEL_TRACES_SAMPLER takes precedence.
+func WithSampleRatio(ratio float64) ObserverOption {
+	return func(c *observerConfig) {
+		c.sampleRatio = ratio
+	}
+}
+
+func newResource(ctx context.Context, cfg *observerConfig) *resource.Resource {
+	attrs := []attribute.KeyValue{semconv.ServiceName(cfg.serviceName)}
+	if cfg.serviceVersion != "" {
+		attrs = append(attrs, semconv.ServiceVersion(cfg.serviceVersion))
+	}
+	if cfg.environment != "" {
+		attrs = append(attrs, semconv.DeploymentEnvironment(cfg.environment))
+	}
+	res, err := resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(attrs...),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithProcessRuntimeName(),
+		resource.WithProcessRuntimeVersion(),
+	)
+	if err != nil {
+		slog.Warn("cannot detect resource attributes", slog.String("error", err.Error()))
+	}
+	return res
+}
+
+// hasTraceExporter tells whether traces have somewhere to go, to avoid
+// dialing the default gRPC endpoint when OpenTelemetry is not configured.
+func hasTraceExporter() bool {
+	if strings.EqualFold(os.Getenv("OTEL_TRACES_EXPORTER"), "none") {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+func newTraceProvider(ctx context.Context, cfg *observerConfig) *sdktrace.TracerProvider {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(cfg.resource)}
+	if _, ok := os.LookupEnv("OTEL_TRACES_SAMPLER"); !ok {
+		opts = append(opts, sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.sampleRatio))))
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	if !hasTraceExporter() {
+		slog.Info("OpenTelemetry tracing exporter not configured")
+		return tp
+	}
+	exp, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		slog.Warn("Cannot Initialize OpenTelemetry tracing via gRPC", slog.String("error", err.Error()))
+		return tp
+	}
+	bsp := sdktrace.NewBatchSpanProcessor(exp)
+	tp.RegisterSpanProcessor(bsp)
+	return tp
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"gotest.tools/v3/assert"
+)
+
+func TestObserverPropagation(t *testing.T) {
+	var sc trace.SpanContext
+	router := http.NewServeMux()
+	router.HandleFunc("GET /test", func(w http.ResponseWriter, r *http.Request) {
+		sc = trace.SpanContextFromContext(r.Context())
+	})
+	obs := NewObserver(context.Background(), router, WithSampleRatio(0))
+
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	obs.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String())
+	assert.Assert(t, sc.IsSampled())
+
+	obs.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+	assert.Assert(t, sc.TraceID() != trace.TraceID{})
+	assert.Assert(t, !sc.IsSampled())
+
+	// Without an endpoint there is no exporter to flush
+	start := time.Now()
+	obs.Shutdown()
+	assert.Assert(t, time.Since(start) < time.Second)
+}
+
+func TestNewResource(t *testing.T) {
+	cfg := &observerConfig{serviceName: "todo-api", serviceVersion: "1.2.3", environment: "staging"}
+	res := newResource(context.Background(), cfg)
+	attrs := res.Set()
+	value, _ := attrs.Value(semconv.ServiceNameKey)
+	assert.Equal(t, "todo-api", value.AsString())
+	value, _ = attrs.Value(semconv.ServiceVersionKey)
+	assert.Equal(t, "1.2.3", value.AsString())
+	value, _ = attrs.Value(semconv.DeploymentEnvironmentKey)
+	assert.Equal(t, "staging", value.AsString())
+
+	t.Setenv("OTEL_SERVICE_NAME", "api")
+	res = newResource(context.Background(), cfg)
+	value, _ = res.Set().Value(semconv.ServiceNameKey)
+	assert.Equal(t, "api", value.AsString())
+}
+
+func TestHasTraceExporter(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	assert.Assert(t, !hasTraceExporter())
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://tempo:4317")
+	assert.Assert(t, hasTraceExporter())
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	assert.Assert(t, !hasTraceExporter())
+}
@@ -3,19 +3,96 @@ package models
 import "time"
 
 type Base struct {
-	Title       string `json:"title,omitempty" gorm:"not null"`
-	Description string `json:"description,omitempty"`
-	Priority    int    `json:"priority,omitempty" gorm:"default:1"`
+	Title       string     `json:"title,omitempty" gorm:"not null"`
+	Description string     `json:"description,omitempty"`
+	Priority    int        `json:"priority,omitempty" gorm:"default:1"`
+	DueAt       *time.Time `json:"due_at,omitempty"`
 }
 
 type Todo struct {
 	Base
-	ID        int       `json:"id,omitempty" gorm:"primary_key"`
-	Completed bool      `json:"completed" gorm:"default:false"`
-	CreatedAt time.Time `json:"created_at,omitempty"`
-	UpdatedAt time.Time `json:"updated_at,omitempty"`
+	ID          int        `json:"id,omitempty" gorm:"primary_key"`
+	Completed   bool       `json:"completed" gorm:"default:false"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	Version     int        `json:"version" gorm:"not null;default:1"`
+	CreatedAt   time.Time  `json:"created_at,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at,omitempty"`
+}
+
+// SetCompleted updates the completion status, returning true when the TODO
+// was just completed.
+func (t *Todo) SetCompleted(completed bool, now time.Time) bool {
+	if completed == t.Completed {
+		return false
+	}
+	t.Completed = completed
+	if completed {
+		t.CompletedAt = &now
+	} else {
+		t.CompletedAt = nil
+	}
+	return completed
 }
 
 type Status struct {
 	Completed bool `json:"completed,omitempty"`
 }
+
+type TodoVersion struct {
+	Base
+	ID        int       `json:"-" gorm:"primary_key"`
+	TodoID    int       `json:"todo_id" gorm:"not null;uniqueIndex:idx_todo_version"`
+	Version   int       `json:"version" gorm:"not null;uniqueIndex:idx_todo_version"`
+	Completed bool      `json:"completed"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+func NewTodoVersion(todo Todo) TodoVersion {
+	return TodoVersion{
+		Base:      todo.Base,
+		TodoID:    todo.ID,
+		Version:   todo.Version,
+		Completed: todo.Completed,
+	}
+}
+
+type PriorityStats struct {
+	Priority  int   `json:"priority"`
+	Open      int64 `json:"open"`
+	Completed int64 `json:"completed"`
+	Overdue   int64 `json:"overdue"`
+}
+
+type Error struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+type Check struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type Health struct {
+	Status  string           `json:"status"`
+	Version string           `json:"version"`
+	Uptime  string           `json:"uptime"`
+	Checks  map[string]Check `json:"checks"`
+}
+
+type ImportRow struct {
+	Line   int    `json:"line"`
+	Title  string `json:"title,omitempty"`
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+type ImportResult struct {
+	DryRun   bool        `json:"dry_run"`
+	Total    int         `json:"total"`
+	Imported int         `json:"imported"`
+	Skipped  int         `json:"skipped"`
+	Failed   int         `json:"failed"`
+	Rows     []ImportRow `json:"rows"`
+}
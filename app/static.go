@@ -0,0 +1,152 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"todo-api/app/middleware"
+)
+
+const indexFile = "index.html"
+
+// precompressed lists the encodings of the files compressed when building
+// the web interface, by order of preference, with their extensions.
+var precompressed = []struct {
+	encoding string
+	ext      string
+}{
+	{middleware.BrotliEncoding, ".br"},
+	{middleware.ZstdEncoding, ".zst"},
+	{middleware.GzipEncoding, ".gz"},
+}
+
+// fingerprinted matches the names of the assets that include a hash of their
+// content, like app.3f2a1b4c.js, which can be cached forever.
+var fingerprinted = regexp.MustCompile(`[.-][0-9a-f]{8,}\.[^/]+$`)
+
+type staticFiles struct {
+	fsys       fs.FS
+	csp        string
+	files      http.Handler
+	etags      map[string]string
+	offers     map[string][]string
+	extensions map[string]string
+}
+
+// staticHandler serves the files of the web interface, using the
+// precompressed variant of a file when one is accepted by the client. Deep
+// links of the single page application get index.html.
+func staticHandler(fsys fs.FS, csp string) http.Handler {
+	s := &staticFiles{
+		fsys:       fsys,
+		csp:        csp,
+		files:      http.FileServer(http.FS(fsys)),
+		etags:      make(map[string]string),
+		offers:     make(map[string][]string),
+		extensions: make(map[string]string),
+	}
+	for _, p := range precompressed {
+		s.extensions[p.encoding] = p.ext
+	}
+	// The embedded files never change, so their tags and variants are
+	// computed once
+	fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		s.etags[name] = `"` + hex.EncodeToString(sum[:8]) + `"`
+		for _, p := range precompressed {
+			if _, err := fs.Stat(fsys, name+p.ext); err == nil {
+				s.offers[name] = append(s.offers[name], p.encoding)
+			}
+		}
+		return nil
+	})
+	return s
+}
+
+func (s *staticFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Content-Security-Policy", s.csp)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, indexFile)
+	}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/"+indexFile):
+		// The file server redirects to the directory
+		s.files.ServeHTTP(w, r)
+	case s.etags[name] != "":
+		s.serveFile(w, r, name)
+	case s.fallback(r):
+		s.serveFile(w, r, indexFile)
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		sendError(w, r, "Not found", http.StatusNotFound)
+	default:
+		s.files.ServeHTTP(w, r)
+	}
+}
+
+// fallback reports whether the path is a route of the web interface rather
+// than a missing asset, which have extensions.
+func (s *staticFiles) fallback(r *http.Request) bool {
+	return !strings.HasPrefix(r.URL.Path, "/api/") &&
+		path.Ext(r.URL.Path) == "" &&
+		s.etags[indexFile] != ""
+}
+
+func (s *staticFiles) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	h := w.Header()
+	file := name
+	if offers := s.offers[name]; len(offers) > 0 {
+		middleware.AddVary(h, "Accept-Encoding")
+		if encoding := middleware.NegotiateEncoding(r.Header.Get("Accept-Encoding"), offers); encoding != "" {
+			file = name + s.extensions[encoding]
+			h.Set("Content-Encoding", encoding)
+		}
+	}
+	f, err := s.fsys.Open(file)
+	if err != nil {
+		sendError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		sendError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		sendError(w, r, "cannot seek "+file, http.StatusInternalServerError)
+		return
+	}
+
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		h.Set("Content-Type", contentType)
+	} else if file != name {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+	h.Set("ETag", s.etags[file])
+	if fingerprinted.MatchString(name) {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		// Revalidated on every use, so new releases are picked up at once
+		h.Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"todo-api/app/config"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestStaticHandler(t *testing.T) {
+	handler := staticHandler(fstest.MapFS{
+		"index.html":       {Data: []byte("<html></html>")},
+		"index.html.gz":    {Data: []byte("gzip index")},
+		"js/app.js":        {Data: []byte("console.log()")},
+		"js/app.js.br":     {Data: []byte("brotli app")},
+		"js/app.js.gz":     {Data: []byte("gzip app")},
+		"img/logo.png":     {Data: []byte("png")},
+		"img/logo.png.txt": {Data: []byte("unrelated")},
+	}, "")
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/js/app.js", "gzip, br")
+	assert.Equal(t, "brotli app", w.Body.String())
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "text/javascript; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+
+	w = get("/js/app.js", "gzip")
+	assert.Equal(t, "gzip app", w.Body.String())
+
+	w = get("/js/app.js", "")
+	assert.Equal(t, "console.log()", w.Body.String())
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+
+	w = get("/", "gzip")
+	assert.Equal(t, "gzip index", w.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+
+	w = get("/index.html", "gzip")
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+
+	w = get("/img/logo.png", "gzip")
+	assert.Equal(t, "png", w.Body.String())
+	assert.Equal(t, "", w.Header().Get("Vary"))
+}
+
+func TestStaticHandlerRouting(t *testing.T) {
+	handler := staticHandler(fstest.MapFS{
+		"index.html":           {Data: []byte("<html></html>")},
+		"js/app.3f2a1b4c.js":   {Data: []byte("fingerprinted")},
+		"favicon.ico":          {Data: []byte("icon")},
+		"css/app.0123abcd.css": {Data: []byte("body {}")},
+	}, contentSecurityPolicy(config.Default().Web))
+	get := func(path string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Deep links of the web interface get index.html
+	for _, path := range []string{"/todos/42", "/settings", "/js/"} {
+		w := get(path)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, "<html></html>", w.Body.String(), path)
+		assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"), path)
+	}
+
+	w := get("/js/missing.4b5c6d7e.js")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = get("/api/v2/todos")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	w = get("/js/app.3f2a1b4c.js")
+	assert.Equal(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+	w = get("/favicon.ico")
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+
+	w = get("/")
+	etag := w.Header().Get("ETag")
+	assert.Assert(t, len(etag) > 2)
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "strict-origin-when-cross-origin", w.Header().Get("Referrer-Policy"))
+	assert.Assert(t, strings.HasPrefix(w.Header().Get("Content-Security-Policy"), "default-src 'self'"))
+
+	w = get("/", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	w = get("/todos/42", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Assert(t, get("/css/app.0123abcd.css").Header().Get("ETag") != etag)
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"todo-api/app/config"
+)
+
+// certReloader serves the certificate from disk, loading it again when its
+// files change so that renewals don't require a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+		now:      time.Now,
+	}
+	r.checked = r.now()
+	return r, r.load()
+}
+
+// modified returns the latest modification time of the files.
+func (r *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load() error {
+	modTime, err := r.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.modTime = &cert, modTime
+	return nil
+}
+
+// GetCertificate checks the files at most once per interval, keeping the
+// current certificate when the new one cannot be loaded, for instance while
+// only one of the files has been replaced.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := r.now(); now.Sub(r.checked) >= r.interval {
+		r.checked = now
+		if modTime, err := r.modified(); err == nil && !modTime.Equal(r.modTime) {
+			if err := r.load(); err != nil {
+				slog.Warn("cannot reload TLS certificate", slog.String("error", err.Error()))
+			} else {
+				slog.Info("reloaded TLS certificate", slog.String("file", r.certFile))
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// newTLSConfig creates the server TLS settings, verifying client
+// certificates against the given CA when requested.
+func newTLSConfig(cfg config.TLS) (*tls.Config, error) {
+	reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile, cfg.ReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + cfg.ClientCAFile)
+		}
+	}
+	switch cfg.ClientAuth {
+	case "optional":
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// redirectPort returns the port of the HTTPS URLs, which is the configured
+// one, or that of the API listener at addr. Unix sockets have no port, so
+// the default one is used unless configured.
+func redirectPort(cfg config.TLS, addr net.Addr) string {
+	if cfg.RedirectPort > 0 {
+		return strconv.Itoa(cfg.RedirectPort)
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return strconv.Itoa(tcp.Port)
+	}
+	return ""
+}
+
+// redirectHandler sends plain HTTP requests to HTTPS on the port, or on the
+// default one when empty.
+func redirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			// IPv6 addresses keep their brackets without a port
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,189 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"todo-api/app/config"
+	"todo-api/app/middleware"
+
+	"gotest.tools/v3/assert"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA
+// when parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.NilError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"TODO"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NilError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+// write stores the certificate and its key as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	assert.NilError(t, err)
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	assert.NilError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600))
+	assert.NilError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, "first", nil)
+	certFile, keyFile := first.write(t, dir, "server")
+
+	now := time.Now()
+	reloader, err := newCertReloader(certFile, keyFile, time.Minute)
+	assert.NilError(t, err)
+	reloader.now, reloader.checked = func() time.Time { return now }, now
+
+	second := newTestCert(t, "second", nil)
+	second.write(t, dir, "server")
+	modTime := now.Add(time.Second)
+	assert.NilError(t, os.Chtimes(certFile, modTime, modTime))
+
+	cert, err := reloader.GetCertificate(nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, first.cert.Raw, cert.Certificate[0])
+
+	now = now.Add(time.Minute)
+	cert, err = reloader.GetCertificate(nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, second.cert.Raw, cert.Certificate[0])
+
+	// A broken pair keeps the current certificate
+	assert.NilError(t, os.WriteFile(keyFile, []byte("invalid"), 0o600))
+	now = now.Add(time.Minute)
+	cert, err = reloader.GetCertificate(nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, second.cert.Raw, cert.Certificate[0])
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "localhost", ca).write(t, dir, "server")
+
+	tc, err := newTLSConfig(config.TLS{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ReloadInterval: time.Minute,
+		ClientCAFile:   caFile,
+		ClientAuth:     "require",
+	})
+	assert.NilError(t, err)
+
+	srv := httptest.NewUnstartedServer(middleware.ClientCertificate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, middleware.Principal(r.Context()))
+	})))
+	srv.TLS = tc
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: certs,
+		}}}
+	}
+
+	resp, err := client(newTestCert(t, "alice", ca).tlsCertificate()).Get(srv.URL)
+	assert.NilError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "alice", string(body))
+
+	_, err = client().Get(srv.URL)
+	assert.Assert(t, err != nil)
+
+	_, err = client(newTestCert(t, "mallory", newTestCert(t, "Other CA", nil)).tlsCertificate()).Get(srv.URL)
+	assert.Assert(t, err != nil)
+}
+
+func TestRedirectHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	redirectHandler("8443").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://todo.example.com:8080/api/v1/todos?completed=true", nil))
+	assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+	assert.Equal(t, "https://todo.example.com:8443/api/v1/todos?completed=true", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	redirectHandler("443").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://todo.example.com/", nil))
+	assert.Equal(t, "https://todo.example.com/", w.Header().Get("Location"))
+
+	for _, tc := range []struct{ host, port, location string }{
+		{"[::1]:8080", "8443", "https://[::1]:8443/"},
+		{"[::1]:8080", "", "https://[::1]/"},
+		{"[::1]", "8443", "https://[::1]:8443/"},
+		{"[::1]", "443", "https://[::1]/"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = tc.host
+		w = httptest.NewRecorder()
+		redirectHandler(tc.port).ServeHTTP(w, r)
+		assert.Equal(t, tc.location, w.Header().Get("Location"), tc.host)
+	}
+}
+
+func TestRedirectPort(t *testing.T) {
+	tcp := &net.TCPAddr{IP: net.IPv6zero, Port: 8443}
+	unix := &net.UnixAddr{Name: "/run/todo/api.sock", Net: "unix"}
+	assert.Equal(t, "8443", redirectPort(config.TLS{}, tcp))
+	// Unix sockets are behind a proxy, whose port is unknown
+	assert.Equal(t, "", redirectPort(config.TLS{}, unix))
+	assert.Equal(t, "9443", redirectPort(config.TLS{RedirectPort: 9443}, unix))
+	assert.Equal(t, "9443", redirectPort(config.TLS{RedirectPort: 9443}, tcp))
+}
@@ -2,29 +2,79 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
 	"todo-api/app/database"
+	"todo-api/app/middleware"
+	"todo-api/app/models"
 )
 
 func getID(w http.ResponseWriter, r *http.Request) int {
 	if id, err := strconv.Atoi(r.PathValue("id")); err == nil {
 		return id
 	} else {
-		http.Error(w, "Invalid ID", http.StatusForbidden)
+		middleware.WriteError(w, r, "Invalid ID", http.StatusForbidden)
 	}
 	return -1
 }
 
+// errWeakIfMatch rejects weak ETags in If-Match, which requires the strong
+// comparison.
+var errWeakIfMatch = errors.New("If-Match does not match weak ETags")
+
+// getIfMatch returns the version expected by the client through the If-Match
+// header, or zero when the header is absent.
+func getIfMatch(r *http.Request) (int, error) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return 0, nil
+	}
+	if strings.HasPrefix(value, "W/") {
+		return 0, errWeakIfMatch
+	}
+	version, err := strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil || version < 1 {
+		return 0, errors.New("Invalid If-Match header")
+	}
+	return version, nil
+}
+
+func setETag(w http.ResponseWriter, todo models.Todo) {
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(todo.Version)))
+}
+
+// decodeJSON reads the request body into v, answering with an error when it
+// is invalid or exceeds the size limit.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		sendError(w, r, err.Error(), middleware.BodyErrorStatus(err))
+		return false
+	}
+	return true
+}
+
 func sendJSON(w http.ResponseWriter, obj any) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(obj)
 }
 
-func handleError(w http.ResponseWriter, err error) {
-	if err == database.ErrorNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
-	} else {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func sendError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if status >= http.StatusInternalServerError {
+		slog.ErrorContext(r.Context(), "request failed", slog.String("error", message))
+	}
+	middleware.WriteError(w, r, message, status)
+}
+
+func handleError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case database.ErrorNotFound:
+		sendError(w, r, err.Error(), http.StatusNotFound)
+	case database.ErrorConflict:
+		sendError(w, r, err.Error(), http.StatusConflict)
+	default:
+		sendError(w, r, err.Error(), http.StatusInternalServerError)
 	}
 }
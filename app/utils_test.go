@@ -27,3 +27,23 @@ func TestGetIDNotFound(t *testing.T) {
 	w := httptest.NewRecorder()
 	assert.Equal(t, -1, getID(w, r))
 }
+
+func TestGetIfMatch(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todos/1/revert", nil)
+	version, err := getIfMatch(r)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, version)
+
+	r.Header.Set("If-Match", `"3"`)
+	version, err = getIfMatch(r)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, version)
+
+	r.Header.Set("If-Match", `W/"3"`)
+	_, err = getIfMatch(r)
+	assert.Equal(t, errWeakIfMatch, err)
+
+	r.Header.Set("If-Match", "abc")
+	_, err = getIfMatch(r)
+	assert.ErrorContains(t, err, "Invalid")
+}
@@ -0,0 +1,32 @@
+// Package version holds the build information of the binary, set at link
+// time with:
+//
+//	go build -ldflags "-X todo-api/app/version.Version=1.0.0 -X todo-api/app/version.Commit=$(git rev-parse HEAD)"
+package version
+
+import "runtime/debug"
+
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if Commit == "" {
+				Commit = setting.Value
+			}
+		case "vcs.time":
+			if Date == "" {
+				Date = setting.Value
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"todo-api/app/config"
+	"todo-api/app/version"
+)
+
+type webConfig struct {
+	Title      string          `json:"title"`
+	Version    string          `json:"version"`
+	APIBaseURL string          `json:"api_base_url"`
+	DocsURL    string          `json:"docs_url,omitempty"`
+	Features   map[string]bool `json:"features"`
+	Auth       *webAuth        `json:"auth,omitempty"`
+}
+
+type webAuth struct {
+	Issuer   string   `json:"issuer"`
+	ClientID string   `json:"client_id"`
+	Scopes   []string `json:"scopes"`
+}
+
+// webConfigHandler tells the web interface how to behave in this
+// environment, as it is built once for all of them.
+func (a *App) webConfigHandler(w http.ResponseWriter, r *http.Request) {
+	web := a.config.Load().Web
+	body := webConfig{
+		Title:      web.Title,
+		Version:    version.Version,
+		APIBaseURL: web.APIBaseURL,
+		DocsURL:    web.DocsURL,
+		Features:   make(map[string]bool, len(web.Features)),
+	}
+	for _, feature := range web.Features {
+		body.Features[feature] = true
+	}
+	if web.Auth.Issuer != "" {
+		body.Auth = &webAuth{Issuer: web.Auth.Issuer, ClientID: web.Auth.ClientID, Scopes: web.Auth.Scopes}
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	sendJSON(w, body)
+}
+
+// contentSecurityPolicy only allows resources from the same origin, besides
+// the API and the identity provider when they are hosted elsewhere.
+func contentSecurityPolicy(web config.Web) string {
+	connect := []string{"'self'"}
+	for _, raw := range []string{web.APIBaseURL, web.Auth.Issuer} {
+		if u, err := url.Parse(raw); err == nil && u.Host != "" {
+			if origin := u.Scheme + "://" + u.Host; !slices.Contains(connect, origin) {
+				connect = append(connect, origin)
+			}
+		}
+	}
+	// Vuetify sets inline styles, and icons are embedded as data URLs
+	return strings.Join([]string{
+		"default-src 'self'",
+		"connect-src " + strings.Join(connect, " "),
+		"img-src 'self' data:",
+		"style-src 'self' 'unsafe-inline'",
+		"font-src 'self' data:",
+		"object-src 'none'",
+		"base-uri 'self'",
+		"frame-ancestors 'none'",
+	}, "; ")
+}
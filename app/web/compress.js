@@ -0,0 +1,47 @@
+/* eslint-env node */
+// Writes the precompressed variants of the built files, which the server
+// sends to the clients that accept them instead of compressing on the fly.
+const fs = require('fs');
+const path = require('path');
+const zlib = require('zlib');
+
+const dist = path.join(__dirname, 'dist');
+const compressible = /\.(html|js|css|svg|json|map|txt|ico)$/;
+const minSize = 1024;
+
+const encoders = {
+  '.br': (data) => zlib.brotliCompressSync(data, {
+    params: { [zlib.constants.BROTLI_PARAM_QUALITY]: zlib.constants.BROTLI_MAX_QUALITY },
+  }),
+  '.gz': (data) => zlib.gzipSync(data, { level: zlib.constants.Z_BEST_COMPRESSION }),
+};
+// Zstandard is only built into recent versions of Node.js
+if (zlib.zstdCompressSync) {
+  encoders['.zst'] = (data) => zlib.zstdCompressSync(data);
+}
+
+function compress(dir) {
+  for (const entry of fs.readdirSync(dir, { withFileTypes: true })) {
+    const file = path.join(dir, entry.name);
+    if (entry.isDirectory()) {
+      compress(file);
+      continue;
+    }
+    if (!compressible.test(entry.name)) {
+      continue;
+    }
+    const data = fs.readFileSync(file);
+    if (data.length < minSize) {
+      continue;
+    }
+    for (const [ext, encode] of Object.entries(encoders)) {
+      const encoded = encode(data);
+      // Variants that don't save anything are left out
+      if (encoded.length < data.length) {
+        fs.writeFileSync(file + ext, encoded);
+      }
+    }
+  }
+}
+
+compress(dist);
@@ -24,4 +24,19 @@ const vuetify = createVuetify({
   directives,
 })
 
-createApp(App).use(vuetify).mount('#app')
+// Settings that differ between environments come from the server at runtime
+const defaults = {
+  title: 'TODO Application',
+  api_base_url: '/api/v1',
+  docs_url: '/swagger/index.html',
+  features: {},
+}
+
+fetch('/config.json')
+  .then((response) => (response.ok ? response.json() : {}))
+  .catch(() => ({}))
+  .then((config) => {
+    const settings = { ...defaults, ...config }
+    document.title = settings.title
+    createApp(App).use(vuetify).provide('config', settings).mount('#app')
+  })
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"todo-api/app/config"
+
+	"gotest.tools/v3/assert"
+)
+
+func getWebConfig(t *testing.T, srv *App) webConfig {
+	t.Helper()
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config.json", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	var body webConfig
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&body))
+	return body
+}
+
+func TestWebConfigHandler(t *testing.T) {
+	srv, _ := newMockApp(false)
+	body := getWebConfig(t, srv)
+	assert.DeepEqual(t, webConfig{
+		Title:      "TODO Application",
+		Version:    "dev",
+		APIBaseURL: "/api/v1",
+		DocsURL:    "/swagger/index.html",
+		Features:   map[string]bool{},
+	}, body)
+
+	cfg := config.Default()
+	cfg.Web.APIBaseURL = "https://api.example.com/api/v1"
+	cfg.Web.Features = []string{"history", "priorities"}
+	cfg.Web.Auth = config.WebAuth{Issuer: "https://id.example.com/realms/todo", ClientID: "todo-web", Scopes: []string{"openid"}}
+	srv.config.Store(cfg)
+	body = getWebConfig(t, srv)
+	assert.Equal(t, "https://api.example.com/api/v1", body.APIBaseURL)
+	assert.DeepEqual(t, map[string]bool{"history": true, "priorities": true}, body.Features)
+	assert.DeepEqual(t, &webAuth{Issuer: "https://id.example.com/realms/todo", ClientID: "todo-web", Scopes: []string{"openid"}}, body.Auth)
+}
+
+func TestContentSecurityPolicy(t *testing.T) {
+	csp := contentSecurityPolicy(config.Default().Web)
+	assert.Assert(t, strings.Contains(csp, "connect-src 'self';"), csp)
+
+	web := config.Default().Web
+	web.APIBaseURL = "https://api.example.com/api/v1"
+	web.Auth.Issuer = "https://api.example.com/auth"
+	csp = contentSecurityPolicy(web)
+	assert.Assert(t, strings.Contains(csp, "connect-src 'self' https://api.example.com;"), csp)
+}
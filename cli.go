@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"todo-api/app/config"
+	"todo-api/app/logging"
+)
+
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+
+	// logLevel can be changed at runtime by reloading the configuration.
+	logLevel = new(slog.LevelVar)
+)
+
+// runner executes a command with the configuration and its positional
+// arguments, returning the exit code.
+type runner func(ctx context.Context, cfg *config.Config, args []string) int
+
+// command is a subcommand of the todo binary. Its setup function registers
+// the flags and returns the runner that uses them.
+type command struct {
+	name    string
+	args    string
+	summary string
+	setup   func(fs *flag.FlagSet) runner
+}
+
+var commands = []command{
+	{"serve", "", "Start the API server (default)", serveCommand},
+	{"migrate", "up|down [steps]|status", "Manage the database schema", migrateCommand},
+	{"seed", "", "Insert sample TODOs", seedCommand},
+	{"export", "", "Write the TODOs as JSON, NDJSON, CSV or Markdown", exportCommand},
+	{"import", "[file]", "Read TODOs as JSON, NDJSON, CSV, todo.txt or Taskwarrior", importCommand},
+	{"version", "", "Print build information", versionCommand},
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// run parses the command line and executes the selected command. Flags take
+// precedence over environment variables, which take precedence over the
+// config file and then the defaults.
+func run(args []string) int {
+	global := newFlagSet("todo", "[flags] <command> [flags] [args]")
+	global.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: todo [flags] <command> [flags] [args]\n\nCommands:")
+		for _, c := range commands {
+			fmt.Fprintf(stderr, "  %-10s %s\n", c.name, c.summary)
+		}
+		fmt.Fprintf(stderr, "  %-10s %s\n", "help", "Print the usage of a command")
+		fmt.Fprintln(stderr, "\nFlags:")
+		global.PrintDefaults()
+		fmt.Fprintln(stderr, "\nRun 'todo <command> -h' for the flags of a command.")
+	}
+	if code, ok := parseFlags(global, args); !ok {
+		return code
+	}
+
+	args = global.Args()
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		return help(global, args)
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(stderr, "todo: unknown command %q\n", name)
+		global.Usage()
+		return 2
+	}
+	fs := newFlagSet("todo "+cmd.name, cmd.args)
+	exec := cmd.setup(fs)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if cmd.name == "version" {
+		// The version is printed even when the configuration is invalid
+		return exec(context.Background(), nil, fs.Args())
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(stderr, "todo: %v\n", err)
+		return 1
+	}
+	logLevel.Set(cfg.Log.Level)
+	slog.SetDefault(logging.New(stderr, cfg.Log.Format, logLevel))
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return exec(ctx, cfg, fs.Args())
+}
+
+// help prints the usage of the command given as argument, or of the binary,
+// without loading the configuration.
+func help(global *flag.FlagSet, args []string) int {
+	if len(args) == 0 {
+		global.Usage()
+		return 0
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(stderr, "todo: unknown command %q\n", args[0])
+		global.Usage()
+		return 2
+	}
+	fs := newFlagSet("todo "+cmd.name, cmd.args)
+	cmd.setup(fs)
+	fs.Usage()
+	return 0
+}
+
+// newFlagSet creates a flag set with the flags shared by every command.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s [flags] %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+	envFlag(fs, "config", "TODO_CONFIG", "YAML or TOML config `file`")
+	envFlag(fs, "log-level", "LOG_LEVEL", "log `level`: debug, info, warn or error")
+	envFlag(fs, "log-format", "LOG_FORMAT", "log `format`: text or json")
+	return fs
+}
+
+// parseFlags parses the arguments, returning false with the exit code when
+// the command must not run.
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0, false
+	}
+	if err != nil {
+		return 2, false
+	}
+	return 0, true
+}
+
+// envFlag defines a flag that overrides an environment variable, so that
+// the rest of the application only has to read the environment.
+func envFlag(fs *flag.FlagSet, name, env, usage string) {
+	fs.Func(name, fmt.Sprintf("%s (env %s)", usage, env), func(value string) error {
+		return os.Setenv(env, value)
+	})
+}
+
+// envBoolFlag is like envFlag for a boolean flag, which can be set with
+// -name or -name=false.
+func envBoolFlag(fs *flag.FlagSet, name, env, usage string) {
+	fs.BoolFunc(name, fmt.Sprintf("%s (env %s)", usage, env), func(value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		return os.Setenv(env, strconv.FormatBool(b))
+	})
+}
+
+// databaseFlags defines the flags for the database connection. The password
+// is deliberately left out, as command lines are visible to other users.
+func databaseFlags(fs *flag.FlagSet) {
+	envFlag(fs, "db-host", "POSTGRES_HOST", "database `host`")
+	envFlag(fs, "db-port", "POSTGRES_PORT", "database `port`")
+	envFlag(fs, "db-name", "POSTGRES_DB", "database `name`")
+	envFlag(fs, "db-user", "POSTGRES_USER", "database `user`")
+}
+
+// loadConfig loads the config file selected with -config, as flags have
+// already been applied to the environment.
+func loadConfig() (*config.Config, error) {
+	return config.Load(os.Getenv("TODO_CONFIG"))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"todo-api/app/version"
+
+	"gotest.tools/v3/assert"
+)
+
+func captureOutput(t *testing.T) (*bytes.Buffer, *bytes.Buffer) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	stdout, stderr = &out, &errOut
+	t.Cleanup(func() { stdout, stderr = os.Stdout, os.Stderr })
+	return &out, &errOut
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "todo.yaml")
+	assert.NilError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestRunVersion(t *testing.T) {
+	out, _ := captureOutput(t)
+	assert.Equal(t, 0, run([]string{"version"}))
+	assert.Assert(t, strings.HasPrefix(out.String(), "version: "+version.Version+"\n"))
+}
+
+func TestRunUsage(t *testing.T) {
+	_, errOut := captureOutput(t)
+	assert.Equal(t, 0, run([]string{"-h"}))
+	assert.Assert(t, strings.Contains(errOut.String(), "migrate"))
+
+	errOut.Reset()
+	assert.Equal(t, 2, run([]string{"unknown"}))
+	assert.Assert(t, strings.Contains(errOut.String(), `unknown command "unknown"`))
+	assert.Equal(t, 2, run([]string{"help", "unknown"}))
+
+	assert.Equal(t, 2, run([]string{"seed", "-count", "many"}))
+	// Flags are applied to the environment, which is restored afterwards
+	t.Setenv("POSTGRES_HOST", os.Getenv("POSTGRES_HOST"))
+	assert.Equal(t, 2, run([]string{"migrate", "-db-host", "localhost"}))
+	assert.Equal(t, 2, run([]string{"export", "-format", "xlsx"}))
+	assert.Equal(t, 2, run([]string{"export", "-priority", "0"}))
+	assert.Equal(t, 2, run([]string{"import", "-format", "xlsx"}))
+	assert.Equal(t, 2, run([]string{"import", "-dedupe", "uuid"}))
+}
+
+func TestPrecedence(t *testing.T) {
+	captureOutput(t)
+	path := writeConfig(t, "database:\n  host: file\n  port: 5433\n  user: file\n  name: file\n")
+	t.Setenv("TODO_CONFIG", "")
+	t.Setenv("POSTGRES_HOST", "env")
+	t.Setenv("POSTGRES_USER", "env")
+	t.Setenv("POSTGRES_DB", "env")
+	os.Unsetenv("POSTGRES_DB")
+
+	assert.Equal(t, 2, run([]string{"-config", path, "migrate", "-db-user", "flag"}))
+	cfg, err := loadConfig()
+	assert.NilError(t, err)
+	assert.Equal(t, "env", cfg.Database.Host)
+	assert.Equal(t, 5433, cfg.Database.Port)
+	assert.Equal(t, "flag", cfg.Database.User)
+	assert.Equal(t, "file", cfg.Database.Name)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, errOut := captureOutput(t)
+	t.Setenv("TODO_CONFIG", "")
+	path := writeConfig(t, "database:\n  port: 0\n")
+
+	assert.Equal(t, 1, run([]string{"-config", path, "seed"}))
+	assert.Assert(t, strings.Contains(errOut.String(), "database.port: must be between 1 and 65535"))
+
+	// The version and the usage don't need a valid configuration
+	errOut.Reset()
+	assert.Equal(t, 0, run([]string{"-config", path, "version"}))
+	assert.Equal(t, 0, run([]string{"-config", path, "help"}))
+	assert.Equal(t, 0, run([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml"), "help", "migrate"}))
+	assert.Assert(t, strings.Contains(errOut.String(), "Usage: todo migrate"))
+	assert.Assert(t, !strings.Contains(errOut.String(), "todo: "))
+}
+
+func TestEnvBoolFlag(t *testing.T) {
+	t.Setenv("POSTGRES_AUTO_MIGRATE", "")
+	fs := newFlagSet("test", "")
+	envBoolFlag(fs, "auto-migrate", "POSTGRES_AUTO_MIGRATE", "")
+
+	assert.NilError(t, fs.Parse([]string{"-auto-migrate"}))
+	assert.Equal(t, "true", os.Getenv("POSTGRES_AUTO_MIGRATE"))
+	assert.NilError(t, fs.Parse([]string{"-auto-migrate=0"}))
+	assert.Equal(t, "false", os.Getenv("POSTGRES_AUTO_MIGRATE"))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"todo-api/app/config"
+	"todo-api/app/database"
+	"todo-api/app/export"
+	"todo-api/app/importer"
+	"todo-api/app/models"
+)
+
+var samples = []models.Base{
+	{Title: "Buy groceries", Description: "Milk, eggs and bread", Priority: 2},
+	{Title: "Book dentist appointment", Priority: 3},
+	{Title: "Renew passport", Description: "Check the photo requirements first", Priority: 1},
+	{Title: "Water the plants", Priority: 2},
+	{Title: "Call mom", Priority: 1},
+	{Title: "Prepare the quarterly report", Description: "Include the latency graphs", Priority: 1},
+	{Title: "Clean the garage", Priority: 3},
+	{Title: "Plan the team offsite", Priority: 2},
+}
+
+// openDB connects to the database, applying the pending migrations when
+// requested and enabled.
+func openDB(cfg *config.Config, migrate bool) (*database.DB, bool) {
+	db := database.NewDB(cfg.Database)
+	connect := db.Connect
+	if migrate {
+		connect = db.Init
+	}
+	if err := connect(); err != nil {
+		slog.Error("cannot connect to the database", slog.String("error", err.Error()))
+		return nil, false
+	}
+	return db, true
+}
+
+func seedCommand(fs *flag.FlagSet) runner {
+	count := fs.Int("count", len(samples), "number of TODOs to insert")
+	databaseFlags(fs)
+	return func(ctx context.Context, cfg *config.Config, args []string) int {
+		if *count < 0 {
+			fs.Usage()
+			return 2
+		}
+		db, ok := openDB(cfg, true)
+		if !ok {
+			return 1
+		}
+		defer db.Shutdown()
+
+		now := time.Now()
+		for i := range *count {
+			todo := samples[i%len(samples)]
+			if i >= len(samples) {
+				todo.Title = fmt.Sprintf("%s (%d)", todo.Title, i/len(samples)+1)
+			}
+			if i%3 == 0 {
+				due := now.AddDate(0, 0, i%14-3).Truncate(time.Hour)
+				todo.DueAt = &due
+			}
+			if _, err := db.Add(ctx, todo); err != nil {
+				slog.Error("cannot insert TODO", slog.String("error", err.Error()))
+				return 1
+			}
+		}
+		fmt.Fprintf(stdout, "inserted %d TODOs\n", *count)
+		return 0
+	}
+}
+
+func exportCommand(fs *flag.FlagSet) runner {
+	output := fs.String("o", "-", "output `file`, - for stdout")
+	format := fs.String("format", export.JSON, "output `format`: "+strings.Join(export.Formats, ", "))
+	// The filters are named after the query parameters of the API
+	filters := url.Values{}
+	for _, f := range []struct{ name, param, usage string }{
+		{"completed", "completed", "only completed (true) or open (false) TODOs"},
+		{"priority", "priority", "only TODOs with this `priority`"},
+		{"due-before", "due_before", "only TODOs due before this RFC 3339 `time`"},
+		{"due-after", "due_after", "only TODOs due at or after this RFC 3339 `time`"},
+		{"q", "q", "only TODOs whose title contains this `text`"},
+	} {
+		fs.Func(f.name, f.usage, func(value string) error {
+			filters.Set(f.param, value)
+			return nil
+		})
+	}
+	databaseFlags(fs)
+	return func(ctx context.Context, cfg *config.Config, args []string) int {
+		filter, err := database.ParseFilter(filters)
+		if err != nil {
+			slog.Error("invalid filter", slog.String("error", err.Error()))
+			return 2
+		}
+		if !slices.Contains(export.Formats, *format) {
+			fs.Usage()
+			return 2
+		}
+		db, ok := openDB(cfg, false)
+		if !ok {
+			return 1
+		}
+		defer db.Shutdown()
+
+		w := stdout
+		if *output != "-" {
+			f, err := os.Create(*output)
+			if err != nil {
+				slog.Error(err.Error())
+				return 1
+			}
+			defer f.Close()
+			w = f
+		}
+		buf := bufio.NewWriter(w)
+		out, _ := export.NewWriter(buf, *format)
+		err = db.Each(ctx, filter, out.Write)
+		if err == nil {
+			err = out.Close()
+		}
+		if err == nil {
+			err = buf.Flush()
+		}
+		if err != nil {
+			slog.Error("cannot write TODOs", slog.String("error", err.Error()))
+			return 1
+		}
+		return 0
+	}
+}
+
+func importCommand(fs *flag.FlagSet) runner {
+	format := fs.String("format", importer.JSON, "input `format`: "+strings.Join(importer.Formats, ", "))
+	dryRun := fs.Bool("dry-run", false, "validate the TODOs without inserting them")
+	dedupe := fs.String("dedupe", "", "comma-separated `fields` identifying duplicates to skip: "+strings.Join(database.DedupeFields, ", "))
+	databaseFlags(fs)
+	return func(ctx context.Context, cfg *config.Config, args []string) int {
+		fields, err := importer.ParseDedupe(*dedupe)
+		if len(args) > 1 || err != nil || !slices.Contains(importer.Formats, *format) {
+			fs.Usage()
+			return 2
+		}
+		var r io.Reader = stdin
+		if len(args) == 1 && args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				slog.Error(err.Error())
+				return 1
+			}
+			defer f.Close()
+			r = f
+		}
+		rows, err := importer.Parse(r, *format)
+		if err != nil {
+			slog.Error("cannot parse TODOs", slog.String("error", err.Error()))
+			return 1
+		}
+
+		db, ok := openDB(cfg, !*dryRun)
+		if !ok {
+			return 1
+		}
+		defer db.Shutdown()
+
+		if err := importer.Import(ctx, db, rows, fields, *dryRun); err != nil {
+			slog.Error("cannot import TODOs", slog.String("error", err.Error()))
+			return 1
+		}
+		result := importer.Summarize(rows)
+		for _, row := range result.Rows {
+			if row.Status != "skipped" {
+				slog.Error("invalid TODO", slog.Int("line", row.Line), slog.String("error", row.Reason))
+			}
+		}
+		switch {
+		case result.Failed > 0:
+			return 1
+		case *dryRun:
+			fmt.Fprintf(stdout, "would import %d TODOs, skipping %d\n", result.Imported, result.Skipped)
+			return 0
+		}
+		fmt.Fprintf(stdout, "imported %d TODOs, skipped %d\n", result.Imported, result.Skipped)
+		return 0
+	}
+}
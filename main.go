@@ -2,17 +2,77 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
 	"os/signal"
 	"syscall"
 	"todo-api/app"
+	"todo-api/app/config"
+	"todo-api/app/version"
 )
 
 func main() {
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
+	os.Exit(run(os.Args[1:]))
+}
+
+func serveCommand(fs *flag.FlagSet) runner {
+	envFlag(fs, "listen", "API_LISTEN", "`address` of the API server")
+	envFlag(fs, "admin-listen", "ADMIN_LISTEN", "`address` of the admin server, empty to disable it")
+	envBoolFlag(fs, "auto-migrate", "POSTGRES_AUTO_MIGRATE", "apply pending migrations at startup")
+	databaseFlags(fs)
+	return func(ctx context.Context, cfg *config.Config, args []string) int {
+		a := app.New(cfg, logLevel)
+		if err := a.Start(ctx); err != nil {
+			slog.Error("cannot start server", slog.String("error", err.Error()))
+			a.Shutdown()
+			return 1
+		}
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				a.Shutdown()
+				return 0
+			case err := <-a.Errors():
+				slog.Error("server failed", slog.String("error", err.Error()))
+				a.Shutdown()
+				return 1
+			case <-hup:
+				reload(a)
+			}
+		}
+	}
+}
+
+// reload applies the settings that can change without a restart, keeping
+// the current ones when the configuration is invalid.
+func reload(a *app.App) {
+	next, err := loadConfig()
+	if err != nil {
+		slog.Error("cannot reload configuration", slog.String("error", err.Error()))
+		return
+	}
+	cfg := a.Reload(next)
+	slog.Info("configuration reloaded",
+		slog.String("log_level", cfg.Log.Level.String()),
+		slog.String("read_limit", cfg.RateLimit.Read.String()),
+		slog.String("write_limit", cfg.RateLimit.Write.String()))
+}
 
-	a := app.New()
-	a.Start(ctx)
-	<-ctx.Done()
-	a.Shutdown()
+func versionCommand(fs *flag.FlagSet) runner {
+	return func(ctx context.Context, cfg *config.Config, args []string) int {
+		fmt.Fprintf(stdout, "version: %s\n", version.Version)
+		if version.Commit != "" {
+			fmt.Fprintf(stdout, "commit:  %s\n", version.Commit)
+		}
+		if version.Date != "" {
+			fmt.Fprintf(stdout, "date:    %s\n", version.Date)
+		}
+		return 0
+	}
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"todo-api/app/config"
+	"todo-api/app/database"
+)
+
+func migrateCommand(fs *flag.FlagSet) runner {
+	databaseFlags(fs)
+	return func(ctx context.Context, cfg *config.Config, args []string) int {
+		if len(args) == 0 {
+			fs.Usage()
+			return 2
+		}
+		return migrate(ctx, fs, cfg, args)
+	}
+}
+
+// migrate runs the "migrate" subcommand, returning the exit code.
+func migrate(ctx context.Context, fs *flag.FlagSet, cfg *config.Config, args []string) int {
+	db := database.NewDB(cfg.Database)
+	if err := db.Connect(); err != nil {
+		slog.Error("cannot connect to the database", slog.String("error", err.Error()))
+		return 1
+	}
+	defer db.Shutdown()
+
+	switch args[0] {
+	case "up":
+		count, err := db.MigrateUp(ctx)
+		if err != nil {
+			slog.Error(err.Error())
+			return 1
+		}
+		fmt.Fprintf(stdout, "applied %d migrations\n", count)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				fs.Usage()
+				return 2
+			}
+		}
+		count, err := db.MigrateDown(ctx, steps)
+		if err != nil {
+			slog.Error(err.Error())
+			return 1
+		}
+		fmt.Fprintf(stdout, "reverted %d migrations\n", count)
+	case "status":
+		status, err := db.MigrationStatus(ctx)
+		if errors.Is(err, database.ErrorNoMigrationsTable) {
+			fmt.Fprintln(stdout, "no migrations table, no migration was applied")
+			return 0
+		} else if err != nil {
+			slog.Error(err.Error())
+			return 1
+		}
+		w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		w.Flush()
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}